@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
 
@@ -33,10 +34,37 @@ Key use cases:
 		SilenceErrors: true,
 		PreRun: func(cmd *cobra.Command, args []string) {
 			bindEnvToFlag(cmd, "addr", "UNREGISTRY_ADDR")
+			bindEnvToFlag(cmd, "allow-namespace", "UNREGISTRY_CONTAINERD_NAMESPACES")
+			bindEnvToFlag(cmd, "content-root", "UNREGISTRY_CONTAINERD_CONTENT_ROOT")
+			bindEnvToFlag(cmd, "docker-fallback", "UNREGISTRY_DOCKER_FALLBACK")
+			bindEnvToFlag(cmd, "docker-load", "UNREGISTRY_DOCKER_LOAD")
+			bindEnvToFlag(cmd, "docker-load-delete", "UNREGISTRY_DOCKER_LOAD_DELETE")
+			bindEnvToFlag(cmd, "docker-sock", "UNREGISTRY_DOCKER_SOCK")
+			bindEnvToFlag(cmd, "gc-on-delete", "UNREGISTRY_GC_ON_DELETE")
+			bindEnvToFlag(cmd, "htpasswd", "UNREGISTRY_HTPASSWD")
 			bindEnvToFlag(cmd, "log-format", "UNREGISTRY_LOG_FORMAT")
 			bindEnvToFlag(cmd, "log-level", "UNREGISTRY_LOG_LEVEL")
+			bindEnvToFlag(cmd, "metrics-addr", "UNREGISTRY_METRICS_ADDR")
+			bindEnvToFlag(cmd, "name-mapping", "UNREGISTRY_NAME_MAPPINGS")
 			bindEnvToFlag(cmd, "namespace", "UNREGISTRY_CONTAINERD_NAMESPACE")
+			bindEnvToFlag(cmd, "namespace-host", "UNREGISTRY_NAMESPACE_HOSTS")
+			bindEnvToFlag(cmd, "peer", "UNREGISTRY_PEERS")
+			bindEnvToFlag(cmd, "peer-password", "UNREGISTRY_PEER_PASSWORD")
+			bindEnvToFlag(cmd, "peer-srv", "UNREGISTRY_PEER_SRV")
+			bindEnvToFlag(cmd, "peer-username", "UNREGISTRY_PEER_USERNAME")
+			bindEnvToFlag(cmd, "regenerate-layers", "UNREGISTRY_REGENERATE_LAYERS")
+			bindEnvToFlag(cmd, "replicate-to", "UNREGISTRY_REPLICATION_TARGETS")
+			bindEnvToFlag(cmd, "replication-queue", "UNREGISTRY_REPLICATION_QUEUE")
+			bindEnvToFlag(cmd, "sibling-namespace", "UNREGISTRY_SIBLING_NAMESPACES")
+			bindEnvToFlag(cmd, "snapshotter", "UNREGISTRY_CONTAINERD_SNAPSHOTTER")
 			bindEnvToFlag(cmd, "sock", "UNREGISTRY_CONTAINERD_SOCK")
+			bindEnvToFlag(cmd, "stale-upload-age", "UNREGISTRY_STALE_UPLOAD_AGE")
+			bindEnvToFlag(cmd, "unpack", "UNREGISTRY_UNPACK")
+			bindEnvToFlag(cmd, "unpack-pipeline", "UNREGISTRY_UNPACK_PIPELINE")
+			bindEnvToFlag(cmd, "unpack-platform", "UNREGISTRY_UNPACK_PLATFORMS")
+			bindEnvToFlag(cmd, "upstream", "UNREGISTRY_UPSTREAM")
+			bindEnvToFlag(cmd, "upstream-password", "UNREGISTRY_UPSTREAM_PASSWORD")
+			bindEnvToFlag(cmd, "upstream-username", "UNREGISTRY_UPSTREAM_USERNAME")
 		},
 		RunE: func(cmd *cobra.Command, args []string) error {
 			return run(cfg)
@@ -51,8 +79,65 @@ Key use cases:
 		"Log verbosity level (debug, info, warn, error)")
 	cmd.Flags().StringVarP(&cfg.ContainerdNamespace, "namespace", "n", "moby",
 		"Containerd namespace to use for image storage")
+	cmd.Flags().StringSliceVar(&cfg.ContainerdNamespaces, "allow-namespace", nil,
+		"Additional containerd namespace that can be selected per request, can be repeated")
+	cmd.Flags().StringToStringVar(&cfg.NamespaceHosts, "namespace-host", nil,
+		"Containerd namespace to use for requests to a host name (e.g., k3s.example.com=k8s.io), can be repeated")
 	cmd.Flags().StringVarP(&cfg.ContainerdSock, "sock", "s", "/run/containerd/containerd.sock",
 		"Path to containerd socket file")
+	cmd.Flags().StringSliceVar(&cfg.SiblingNamespaces, "sibling-namespace", nil,
+		"Containerd namespace to reuse existing blobs from instead of uploading them, can be repeated")
+	cmd.Flags().StringArrayVar(&cfg.NameMappings, "name-mapping", nil,
+		"Rule to rewrite repository names to containerd image names as REGEX=REPLACEMENT "+
+			"(e.g., '^localhost-([0-9]+)/(.+)$=localhost:$1/$2'), can be repeated "+
+			"or set as one rule per line in UNREGISTRY_NAME_MAPPINGS")
+	cmd.Flags().StringVar(&cfg.MetricsAddr, "metrics-addr", "",
+		"Address and port to serve Prometheus metrics on at /metrics (e.g., 127.0.0.1:5001), disabled if empty")
+	cmd.Flags().StringVar(&cfg.ContainerdContentRoot, "content-root", "",
+		"Path to containerd content store directory to serve blobs directly from disk "+
+			"(e.g., /var/lib/containerd/io.containerd.content.v1.content)")
+	cmd.Flags().BoolVar(&cfg.GCOnDelete, "gc-on-delete", false,
+		"Run containerd garbage collection synchronously when images are deleted through the registry API")
+	cmd.Flags().DurationVar(&cfg.StaleUploadAge, "stale-upload-age", time.Hour,
+		"Age after which interrupted uploads are cleaned up from containerd, at least 1h (0 to disable)")
+	cmd.Flags().BoolVar(&cfg.Unpack, "unpack", false,
+		"Unpack pushed images into the containerd snapshotter when they are tagged")
+	cmd.Flags().StringVar(&cfg.Snapshotter, "snapshotter", "overlayfs",
+		"Containerd snapshotter to unpack images into")
+	cmd.Flags().StringSliceVar(&cfg.UnpackPlatforms, "unpack-platform", nil,
+		"Platform to unpack images for, can be repeated (default: host platform)")
+	cmd.Flags().BoolVar(&cfg.UnpackPipeline, "unpack-pipeline", false,
+		"Apply pushed layers into the snapshotter while the push is still uploading (requires --unpack)")
+	cmd.Flags().BoolVar(&cfg.RegenerateLayers, "regenerate-layers", false,
+		"Regenerate layers deleted from containerd after unpacking from the snapshots in the containerd snapshotter")
+	cmd.Flags().BoolVar(&cfg.DockerLoad, "docker-load", false,
+		"Load pushed images into Docker that doesn't use the containerd image store when they are tagged")
+	cmd.Flags().BoolVar(&cfg.DockerFallback, "docker-fallback", false,
+		"Serve images from Docker that doesn't use the containerd image store if they are not in containerd")
+	cmd.Flags().StringSliceVar(&cfg.Peers, "peer", nil,
+		"URL of another unregistry instance to fetch missing images from (e.g., http://node2:5000), can be repeated")
+	cmd.Flags().StringVar(&cfg.PeerSRV, "peer-srv", "",
+		"DNS SRV record name to discover unregistry peers (e.g., _unregistry._tcp.example.com)")
+	cmd.Flags().StringVar(&cfg.PeerUsername, "peer-username", "",
+		"Username to authenticate to unregistry peers and replication targets")
+	cmd.Flags().StringVar(&cfg.PeerPassword, "peer-password", "",
+		"Password to authenticate to unregistry peers and replication targets")
+	cmd.Flags().StringSliceVar(&cfg.ReplicationTargets, "replicate-to", nil,
+		"URL of another unregistry instance to push tagged images to (e.g., http://node2:5000), can be repeated")
+	cmd.Flags().StringVar(&cfg.ReplicationQueue, "replication-queue", "/var/lib/unregistry/replication.json",
+		"Path to the file that persists pending replications across restarts")
+	cmd.Flags().StringVar(&cfg.Upstream, "upstream", "",
+		"URL of the registry to pull missing images through from (e.g., https://registry-1.docker.io), disabled if empty")
+	cmd.Flags().StringVar(&cfg.UpstreamUsername, "upstream-username", "",
+		"Username to authenticate to the upstream registry")
+	cmd.Flags().StringVar(&cfg.UpstreamPassword, "upstream-password", "",
+		"Password to authenticate to the upstream registry")
+	cmd.Flags().StringVar(&cfg.HtpasswdPath, "htpasswd", "",
+		"Path to the htpasswd file with bcrypt password hashes to require basic authentication, disabled if empty")
+	cmd.Flags().StringVar(&cfg.DockerSock, "docker-sock", "/var/run/docker.sock",
+		"Path to Docker Engine API socket file used to load and export images")
+	cmd.Flags().BoolVar(&cfg.DockerLoadDelete, "docker-load-delete", false,
+		"Delete images from containerd once they are loaded into Docker")
 
 	if err := cmd.Execute(); err != nil {
 		logrus.WithError(err).Fatal("Registry server failed.")
@@ -94,9 +179,19 @@ func run(cfg unregistry.Config) error {
 	return nil
 }
 
+// bindEnvToFlag sets the flag from the environment variable if the flag is not set on the command line. Slice flags
+// split the value on commas. Array flags, e.g. --name-mapping, whose values may contain commas take one value per line.
 func bindEnvToFlag(cmd *cobra.Command, flagName, envVar string) {
-	if value := os.Getenv(envVar); value != "" && !cmd.Flags().Changed(flagName) {
-		if err := cmd.Flags().Set(flagName, value); err != nil {
+	value := os.Getenv(envVar)
+	if value == "" || cmd.Flags().Changed(flagName) {
+		return
+	}
+	values := []string{value}
+	if cmd.Flags().Lookup(flagName).Value.Type() == "stringArray" {
+		values = strings.FieldsFunc(value, func(r rune) bool { return r == '\n' || r == '\r' })
+	}
+	for _, v := range values {
+		if err := cmd.Flags().Set(flagName, v); err != nil {
 			logrus.WithError(err).Fatalf("Failed to bind environment variable '%s' to flag '%s'.", envVar, flagName)
 		}
 	}
@@ -1,5 +1,7 @@
 package unregistry
 
+import "time"
+
 // Config represents the registry configuration.
 type Config struct {
 	// Addr is the address on which the registry server will listen.
@@ -8,6 +10,80 @@ type Config struct {
 	ContainerdSock string
 	// ContainerdNamespace is the containerd namespace to use for storing images.
 	ContainerdNamespace string
+	// ContainerdNamespaces are additional containerd namespaces that can be selected per request with the
+	// Unregistry-Namespace header, a repository name prefix, or a host name in NamespaceHosts.
+	ContainerdNamespaces []string
+	// NamespaceHosts maps request host names to the containerd namespaces to use for them.
+	NamespaceHosts map[string]string
+	// SiblingNamespaces are containerd namespaces to reuse blobs from when they're missing in the request namespace
+	// so that clients don't have to upload content that already exists on the host.
+	SiblingNamespaces []string
+	// NameMappings are rules in the "REGEX=REPLACEMENT" format that rewrite repository names in requests to
+	// the containerd image names, e.g. `^localhost-([0-9]+)/(.+)$=localhost:$1/$2` to store an image pushed as
+	// localhost-5000/myapp under localhost:5000/myapp. The first matching rule applies.
+	NameMappings []string
+	// ContainerdContentRoot is the optional path to the root directory of the containerd content store on the local
+	// disk, e.g. /var/lib/containerd/io.containerd.content.v1.content. If set and accessible, blobs are served directly
+	// from the files using zero-copy transfers instead of streaming them through the containerd API.
+	ContainerdContentRoot string
+	// GCOnDelete enables synchronous containerd garbage collection when images are deleted through the registry API
+	// so that the freed space is reclaimed and reported immediately.
+	GCOnDelete bool
+	// StaleUploadAge is the age after which interrupted uploads (partial ingests and leases in containerd) are
+	// considered stale and cleaned up on startup and periodically. Zero disables the cleanup.
+	StaleUploadAge time.Duration
+	// Unpack enables unpacking of pushed images into the Snapshotter when they're tagged so that containers can be
+	// started from them immediately.
+	Unpack bool
+	// Snapshotter is the containerd snapshotter to unpack images into, e.g. "overlayfs".
+	Snapshotter string
+	// UnpackPlatforms is the list of platforms to unpack images for, e.g. "linux/amd64". The host platform is used
+	// if empty.
+	UnpackPlatforms []string
+	// UnpackPipeline enables applying pushed layers into the Snapshotter while the push is still uploading so that
+	// tagging the image only has to wait for the last layer. Requires Unpack.
+	UnpackPipeline bool
+	// RegenerateLayers enables recreating layers that containerd deleted after unpacking (discard_unpacked_layers)
+	// from the unpacked snapshots in the Snapshotter when they're pulled.
+	RegenerateLayers bool
+	// DockerLoad enables loading of pushed images into the classic Docker image store through the Docker Engine API
+	// when they're tagged. It's useful when Docker doesn't use the containerd image store.
+	DockerLoad bool
+	// DockerFallback enables serving images from the classic Docker image store when they don't exist in containerd.
+	// The images are imported from Docker into containerd on the first pull.
+	DockerFallback bool
+	// Upstream is the optional URL of the registry to pull images and blobs through from when they don't exist in
+	// containerd, e.g. https://registry-1.docker.io. Fetched content is stored in containerd and the images are tagged.
+	Upstream string
+	// UpstreamUsername is the optional username to authenticate to the Upstream registry.
+	UpstreamUsername string
+	// UpstreamPassword is the optional password to authenticate to the Upstream registry.
+	UpstreamPassword string
+	// Peers are the optional URLs of other unregistry instances, e.g. http://node2:5000, to fetch images and blobs
+	// from when they don't exist in containerd, before the Upstream registry.
+	Peers []string
+	// PeerSRV is the optional DNS SRV record name to discover Peers, e.g. _unregistry._tcp.example.com.
+	PeerSRV string
+	// PeerUsername is the optional username to authenticate to Peers and ReplicationTargets. Required with
+	// PeerPassword if HtpasswdPath is set as the other instances are expected to require authentication too.
+	PeerUsername string
+	// PeerPassword is the optional password to authenticate to Peers and ReplicationTargets.
+	PeerPassword string
+	// ReplicationTargets are the optional URLs of other unregistry instances, e.g. http://node2:5000, to push tagged
+	// images to in the background.
+	ReplicationTargets []string
+	// ReplicationQueue is the path to the file that persists pending replications across restarts.
+	ReplicationQueue string
+	// HtpasswdPath is the optional path to the htpasswd file with bcrypt password hashes to require clients to
+	// authenticate with HTTP basic authentication. The file is reloaded when it changes. Authentication is disabled
+	// if empty.
+	HtpasswdPath string
+	// DockerSock is the path to the Docker Engine API socket used to load and export images.
+	DockerSock string
+	// DockerLoadDelete deletes images from the containerd image store once they're loaded into Docker.
+	DockerLoadDelete bool
+	// MetricsAddr is the optional address to serve Prometheus metrics on at /metrics. Metrics are not served if empty.
+	MetricsAddr string
 	// LogLevel is one of "debug", "info", "warn", "error".
 	LogLevel string
 	// LogFormatter to use for the logs. Either "text" or "json".
@@ -0,0 +1,69 @@
+package containerd
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/distribution/distribution/v3/registry/api/errcode"
+	"github.com/distribution/distribution/v3/registry/auth"
+	// Register htpasswd access controller.
+	_ "github.com/distribution/distribution/v3/registry/auth/htpasswd"
+	"github.com/sirupsen/logrus"
+)
+
+// authRealm is the realm in the basic authentication challenge sent to unauthenticated clients.
+const authRealm = "unregistry"
+
+// NewAuthHandler returns an http.Handler that requires clients to authenticate with HTTP basic authentication using
+// the credentials in the htpasswd file at the given path, e.g. created with "htpasswd -Bc". Only bcrypt password hashes
+// are supported. The file is reloaded when it changes so that users can be added or removed without a restart.
+// Failed logins are logged with the client address.
+//
+// The handler uses the htpasswd access controller of the distribution registry but wraps all the routes, including
+// the API extensions served outside the distribution registry app, e.g. referrers and replication status.
+func NewAuthHandler(htpasswdPath string, next http.Handler) (http.Handler, error) {
+	// The distribution access controller creates the missing file with a random user and logs its password. Require
+	// the file to exist instead to avoid silently locking out the clients because of a typo in the path.
+	if _, err := os.Stat(htpasswdPath); err != nil {
+		return nil, fmt.Errorf("htpasswd file: %w", err)
+	}
+	controller, err := auth.GetAccessController("htpasswd", map[string]interface{}{
+		"realm": authRealm,
+		"path":  htpasswdPath,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("create htpasswd access controller: %w", err)
+	}
+	log := logrus.WithField("component", "auth")
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, err := controller.Authorized(r)
+		if err == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		var challenge auth.Challenge
+		if !errors.As(err, &challenge) {
+			// The htpasswd file can't be read or parsed. Don't expose the details to the client.
+			log.WithField("path", htpasswdPath).WithError(err).Error("Failed to check credentials.")
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		// Requests without credentials are expected as clients authenticate only after receiving the challenge.
+		if username, _, ok := r.BasicAuth(); ok {
+			fields := logrus.Fields{
+				"remote":   r.RemoteAddr,
+				"username": username,
+			}
+			if forwardedFor := r.Header.Get("X-Forwarded-For"); forwardedFor != "" {
+				fields["forwarded_for"] = forwardedFor
+			}
+			log.WithFields(fields).Warn("Failed login.")
+		}
+		challenge.SetHeaders(r, w)
+		_ = errcode.ServeJSON(w, errcode.ErrorCodeUnauthorized)
+	}), nil
+}
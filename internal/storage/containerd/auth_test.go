@@ -0,0 +1,96 @@
+package containerd
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// aliceHtpasswd is the htpasswd entry for the user "alice" with the password "secret".
+	aliceHtpasswd = "alice:$2a$04$pmt1k1Pg4t5X/ag917Lm6.EeasnJgZ6Uhh4vHj/8dD6P39xFBD/aa\n"
+	// bobHtpasswd is the htpasswd entry for the user "bob" with the password "changed".
+	bobHtpasswd = "bob:$2a$04$VLZloBLNNzomduRqloSsXOwAwZusc/1VD.ArZFn8FP0VlYSONvVjG\n"
+)
+
+func TestAuthHandler(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "htpasswd")
+	if err := os.WriteFile(path, []byte(aliceHtpasswd), 0o600); err != nil {
+		t.Fatalf("write htpasswd: %v", err)
+	}
+	handler, err := NewAuthHandler(path, http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	if err != nil {
+		t.Fatalf("create auth handler: %v", err)
+	}
+
+	var logs bytes.Buffer
+	logrus.SetOutput(&logs)
+	t.Cleanup(func() { logrus.SetOutput(os.Stderr) })
+
+	serve := func(username, password string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/v2/", nil)
+		req.RemoteAddr = "192.0.2.1:4242"
+		if username != "" {
+			req.SetBasicAuth(username, password)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := serve("", "")
+	if rec.Code != http.StatusUnauthorized {
+		t.Fatalf("no credentials: status = %d, want %d", rec.Code, http.StatusUnauthorized)
+	}
+	if got, want := rec.Header().Get("WWW-Authenticate"), `Basic realm="unregistry"`; got != want {
+		t.Errorf("no credentials: WWW-Authenticate = %q, want %q", got, want)
+	}
+	if strings.Contains(logs.String(), "Failed login") {
+		t.Errorf("no credentials: unexpected failed login logged: %s", logs.String())
+	}
+
+	if rec = serve("alice", "secret"); rec.Code != http.StatusOK {
+		t.Errorf("valid credentials: status = %d, want %d", rec.Code, http.StatusOK)
+	}
+
+	if rec = serve("alice", "wrong"); rec.Code != http.StatusUnauthorized {
+		t.Errorf("wrong password: status = %d, want %d", rec.Code, http.StatusUnauthorized)
+	}
+	if !strings.Contains(logs.String(), "Failed login") || !strings.Contains(logs.String(), "192.0.2.1:4242") {
+		t.Errorf("wrong password: failed login with client address not logged: %s", logs.String())
+	}
+
+	// Replace alice with bob and make sure the modification time changes even on coarse-grained filesystems.
+	if err = os.WriteFile(path, []byte(bobHtpasswd), 0o600); err != nil {
+		t.Fatalf("write htpasswd: %v", err)
+	}
+	modTime := time.Now().Add(time.Minute)
+	if err = os.Chtimes(path, modTime, modTime); err != nil {
+		t.Fatalf("change htpasswd times: %v", err)
+	}
+	if rec = serve("bob", "changed"); rec.Code != http.StatusOK {
+		t.Errorf("added user: status = %d, want %d", rec.Code, http.StatusOK)
+	}
+	if rec = serve("alice", "secret"); rec.Code != http.StatusUnauthorized {
+		t.Errorf("removed user: status = %d, want %d", rec.Code, http.StatusUnauthorized)
+	}
+}
+
+func TestAuthHandlerMissingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "htpasswd")
+	if _, err := NewAuthHandler(path, http.NotFoundHandler()); err == nil {
+		t.Fatal("expected error for missing htpasswd file")
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("htpasswd file must not be created: %v", err)
+	}
+}
@@ -2,32 +2,121 @@ package containerd
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/containerd/containerd/v2/client"
 	"github.com/containerd/containerd/v2/core/content"
 	"github.com/containerd/errdefs"
 	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/registry/api/errcode"
 	"github.com/distribution/reference"
 	"github.com/opencontainers/go-digest"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/sirupsen/logrus"
 )
 
+const (
+	// mediaTypeLabel is the label set on content in the containerd content store to preserve the media type of blobs
+	// and manifests pushed through the registry.
+	mediaTypeLabel = "unregistry.io/mediatype"
+	// defaultMediaType is the media type reported for content without a known media type.
+	defaultMediaType = "application/octet-stream"
+)
+
+// blobPathRegexp matches the path of the blob endpoint: /v2/<name>/blobs/<digest>.
+var blobPathRegexp = regexp.MustCompile(`^/v2/(` + reference.NameRegexp.String() + `)/blobs/[^/]+:[^/]+$`)
+
+// blobHeadRequestKey is the context key for marking HEAD requests for blobs.
+type blobHeadRequestKey struct{}
+
+// NewBlobHeadHandler returns an http.Handler that marks HEAD requests for blobs so that they're answered only from
+// the local containerd. Clients such as docker push check whether a blob exists with a HEAD request before uploading
+// it. Reporting a blob that only exists in a peer or the upstream registry as existing would make them skip the upload
+// and push an image with layers missing in containerd.
+func NewBlobHeadHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodHead && blobPathRegexp.MatchString(r.URL.Path) {
+			r = r.WithContext(context.WithValue(r.Context(), blobHeadRequestKey{}, true))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// isBlobHeadRequest checks if the request is a HEAD request for a blob that must only be answered from the local
+// containerd.
+func isBlobHeadRequest(ctx context.Context) bool {
+	head, _ := ctx.Value(blobHeadRequestKey{}).(bool)
+	return head
+}
+
 // blobStore implements distribution.BlobStore backed by containerd image store.
 type blobStore struct {
 	client *client.Client
 	repo   reference.Named
+	// uploadLeases keeps track of containerd leases created by blob writers to upload content.
+	uploadLeases *uploadLeases
+	// contentRoot is the optional path to the root directory of the containerd content store on the local disk.
+	// If set, blobs are served directly from the files in the content store to allow zero-copy transfers.
+	contentRoot string
+	// unpackPipeline applies committed layers into the containerd snapshotter while the push is still uploading.
+	// Nil if the pipeline is disabled.
+	unpackPipeline *unpackPipeline
+	// regenerator recreates layers deleted from the containerd content store after unpacking from the snapshots.
+	// Nil if regeneration is disabled.
+	regenerator *layerRegenerator
+	// siblingNamespaces are the containerd namespaces to reuse blobs from that are missing in the request namespace.
+	siblingNamespaces []string
+	// peers fetches blobs missing in containerd from other unregistry instances. Nil if no peers are configured.
+	peers *peers
+	// upstream fetches blobs missing in containerd from the upstream registry. Nil if pull-through is disabled.
+	upstream *upstream
+	// dockerSource imports the images of the repository from the classic Docker image store to find blobs missing in
+	// containerd. Nil if disabled.
+	dockerSource *dockerSource
+	// nameMappings rewrite the repository name to the image name in Docker the same way as for tags.
+	nameMappings []nameMapping
 }
 
-// Stat returns metadata about a blob in the containerd content store by its digest.
-// If the blob doesn't exist, distribution.ErrBlobUnknown will be returned.
+// Stat returns metadata about a blob in the containerd content store by its digest. If the blob is missing,
+// the images of the repository are imported from Docker or metadata of the blob in a peer or the upstream registry is
+// returned without fetching it, except for HEAD requests for blobs that report only the blobs in containerd. If
+// the blob doesn't exist, distribution.ErrBlobUnknown will be returned.
 func (b *blobStore) Stat(ctx context.Context, dgst digest.Digest) (distribution.Descriptor, error) {
+	desc, err := b.statLocal(ctx, dgst)
+	if err != nil && errors.Is(err, distribution.ErrBlobUnknown) {
+		desc, err = b.statDocker(ctx, dgst)
+	}
+	if err != nil && errors.Is(err, distribution.ErrBlobUnknown) {
+		_, desc, err = b.statRemote(ctx, dgst)
+	}
+	return desc, err
+}
+
+// statLocal returns metadata about a blob in the containerd content store by its digest without looking it up in
+// the upstream registry. If the blob doesn't exist, distribution.ErrBlobUnknown will be returned.
+func (b *blobStore) statLocal(ctx context.Context, dgst digest.Digest) (distribution.Descriptor, error) {
 	info, err := b.client.ContentStore().Info(ctx, dgst)
+	if err != nil && errdefs.IsNotFound(err) && len(b.siblingNamespaces) > 0 {
+		info, err = b.mountFromSibling(ctx, dgst)
+	}
 	if err != nil {
 		if errdefs.IsNotFound(err) {
+			if b.regenerator != nil {
+				if replacement, ok := b.regenerator.replacement(ctx, dgst); ok {
+					return distribution.Descriptor{}, errcode.ErrorCodeBlobUnknown.WithDetail(
+						regeneratedLayerError(dgst, replacement),
+					)
+				}
+			}
 			return distribution.Descriptor{}, distribution.ErrBlobUnknown
 		}
 		return distribution.Descriptor{}, fmt.Errorf(
@@ -35,17 +124,123 @@ func (b *blobStore) Stat(ctx context.Context, dgst digest.Digest) (distribution.
 		)
 	}
 
+	mediaType := info.Labels[mediaTypeLabel]
+	if mediaType == "" {
+		mediaType = defaultMediaType
+	}
+
 	return distribution.Descriptor{
-		MediaType: "application/octet-stream",
+		MediaType: mediaType,
 		Digest:    info.Digest,
 		Size:      info.Size,
 	}, nil
 }
 
+// statDocker imports the images of the repository that exist in the classic Docker image store but not in containerd
+// and returns metadata about the blob if one of them contains it. HEAD requests for blobs don't import images as
+// clients send them before uploading blobs. If the blob doesn't exist, distribution.ErrBlobUnknown will be returned.
+func (b *blobStore) statDocker(ctx context.Context, dgst digest.Digest) (distribution.Descriptor, error) {
+	if b.dockerSource == nil || isBlobHeadRequest(ctx) {
+		return distribution.Descriptor{}, distribution.ErrBlobUnknown
+	}
+
+	imported, err := b.dockerSource.importRepository(ctx, canonicalRepository(ctx, b.repo, b.nameMappings))
+	if err != nil {
+		return distribution.Descriptor{}, fmt.Errorf("find blob '%s' in docker: %w", dgst, err)
+	}
+	if !imported {
+		return distribution.Descriptor{}, distribution.ErrBlobUnknown
+	}
+	return b.statLocal(ctx, dgst)
+}
+
+// statRemote finds a blob missing in the containerd content store in the peers, then in the upstream registry,
+// and returns the registry to fetch it from and the blob metadata. Requests from peers are only served from
+// the local containerd, as well as HEAD requests for blobs. If the blob doesn't exist, distribution.ErrBlobUnknown will
+// be returned.
+func (b *blobStore) statRemote(ctx context.Context, dgst digest.Digest) (*upstream, distribution.Descriptor, error) {
+	if isPeerRequest(ctx) || isBlobHeadRequest(ctx) {
+		return nil, distribution.Descriptor{}, distribution.ErrBlobUnknown
+	}
+
+	if b.peers != nil {
+		if peer, desc, err := b.peers.findBlob(ctx, b.repo, dgst); err == nil {
+			return peer, withDefaultMediaType(desc), nil
+		}
+	}
+
+	if b.upstream == nil {
+		return nil, distribution.Descriptor{}, distribution.ErrBlobUnknown
+	}
+	desc, err := b.upstream.stat(ctx, b.repo, dgst)
+	if err != nil {
+		if errdefs.IsNotFound(err) {
+			return nil, distribution.Descriptor{}, distribution.ErrBlobUnknown
+		}
+		return nil, distribution.Descriptor{}, fmt.Errorf(
+			"get metadata for blob '%s' from upstream registry: %w", dgst, err,
+		)
+	}
+
+	return b.upstream, withDefaultMediaType(desc), nil
+}
+
+// fetchMissing makes a blob missing in the containerd content store available by importing the images of
+// the repository from Docker or fetching it from a peer or the upstream registry. If the blob doesn't exist,
+// distribution.ErrBlobUnknown will be returned.
+func (b *blobStore) fetchMissing(ctx context.Context, dgst digest.Digest) error {
+	if _, err := b.statDocker(ctx, dgst); !errors.Is(err, distribution.ErrBlobUnknown) {
+		return err
+	}
+
+	remote, desc, err := b.statRemote(ctx, dgst)
+	if err != nil {
+		return err
+	}
+	if err = remote.fetchBlob(ctx, b.repo, desc); err != nil {
+		if errdefs.IsNotFound(err) {
+			return distribution.ErrBlobUnknown
+		}
+		return err
+	}
+	return nil
+}
+
+// withDefaultMediaType returns the descriptor with the default media type if it's unknown.
+func withDefaultMediaType(desc ocispec.Descriptor) distribution.Descriptor {
+	if desc.MediaType == "" {
+		desc.MediaType = defaultMediaType
+	}
+	return desc
+}
+
+// setMediaType labels the blob in the containerd content store with the given media type so that it's returned
+// by Stat. If the blob doesn't exist, distribution.ErrBlobUnknown will be returned.
+func (b *blobStore) setMediaType(ctx context.Context, dgst digest.Digest, mediaType string) error {
+	info := content.Info{
+		Digest: dgst,
+		Labels: map[string]string{mediaTypeLabel: mediaType},
+	}
+	if _, err := b.client.ContentStore().Update(ctx, info, "labels."+mediaTypeLabel); err != nil {
+		if errdefs.IsNotFound(err) {
+			return distribution.ErrBlobUnknown
+		}
+		return fmt.Errorf("set media type label for blob '%s' in containerd content store: %w", dgst, err)
+	}
+
+	return nil
+}
+
 // Get retrieves the content of a blob in the containerd content store by its digest.
 // If the blob doesn't exist, distribution.ErrBlobUnknown will be returned.
 func (b *blobStore) Get(ctx context.Context, dgst digest.Digest) ([]byte, error) {
 	blob, err := content.ReadBlob(ctx, b.client.ContentStore(), ocispec.Descriptor{Digest: dgst})
+	if err != nil && errdefs.IsNotFound(err) {
+		if err = b.fetchMissing(ctx, dgst); err != nil {
+			return nil, err
+		}
+		blob, err = content.ReadBlob(ctx, b.client.ContentStore(), ocispec.Descriptor{Digest: dgst})
+	}
 	if err != nil {
 		if errdefs.IsNotFound(err) {
 			return nil, distribution.ErrBlobUnknown
@@ -59,6 +254,12 @@ func (b *blobStore) Get(ctx context.Context, dgst digest.Digest) ([]byte, error)
 // Open returns a reader for the blob in the containerd content store by its digest.
 func (b *blobStore) Open(ctx context.Context, dgst digest.Digest) (io.ReadSeekCloser, error) {
 	reader, err := newBlobReadSeekCloser(ctx, b.client.ContentStore(), ocispec.Descriptor{Digest: dgst})
+	if err != nil && errdefs.IsNotFound(err) {
+		if err = b.fetchMissing(ctx, dgst); err != nil {
+			return nil, err
+		}
+		reader, err = newBlobReadSeekCloser(ctx, b.client.ContentStore(), ocispec.Descriptor{Digest: dgst})
+	}
 	if err != nil {
 		if errdefs.IsNotFound(err) {
 			return nil, distribution.ErrBlobUnknown
@@ -73,7 +274,8 @@ func (b *blobStore) Open(ctx context.Context, dgst digest.Digest) (io.ReadSeekCl
 // it will return the existing descriptor without re-uploading the content. It should be used for small objects,
 // such as manifests.
 func (b *blobStore) Put(ctx context.Context, mediaType string, blob []byte) (distribution.Descriptor, error) {
-	writer, err := newBlobWriter(ctx, b.client, b.repo, "")
+	// Small objects put directly aren't layers or image configs so they don't need to be passed to the pipeline.
+	writer, err := newBlobWriter(ctx, b.client, b.repo, "", b.uploadLeases, nil)
 	if err != nil {
 		return distribution.Descriptor{}, err
 	}
@@ -101,60 +303,243 @@ func (b *blobStore) Put(ctx context.Context, mediaType string, blob []byte) (dis
 	return desc, nil
 }
 
-// Create creates a blob writer to add a blob to the containerd content store.
-func (b *blobStore) Create(ctx context.Context, _ ...distribution.BlobCreateOption) (
+// Create creates a blob writer to add a blob to the containerd content store. If a cross-repository mount is
+// requested and the blob exists, distribution.ErrBlobMounted is returned instead so that the client skips the upload.
+func (b *blobStore) Create(ctx context.Context, options ...distribution.BlobCreateOption) (
 	distribution.BlobWriter, error,
 ) {
-	return newBlobWriter(ctx, b.client, b.repo, "")
+	var opts distribution.CreateOptions
+	for _, option := range options {
+		if err := option.Apply(&opts); err != nil {
+			return nil, err
+		}
+	}
+
+	if opts.Mount.ShouldMount {
+		desc, err := b.Mount(ctx, opts.Mount.From, opts.Mount.From.Digest())
+		if err == nil {
+			return nil, distribution.ErrBlobMounted{
+				From:       opts.Mount.From,
+				Descriptor: desc,
+			}
+		}
+		if !errors.Is(err, distribution.ErrBlobUnknown) {
+			return nil, err
+		}
+		// Fall back to a regular upload if the blob doesn't exist.
+	}
+
+	return newBlobWriter(ctx, b.client, b.repo, "", b.uploadLeases, b.unpackPipeline)
 }
 
 // Resume creates a blob writer for resuming an upload with a specific ID.
 func (b *blobStore) Resume(ctx context.Context, id string) (distribution.BlobWriter, error) {
-	return newBlobWriter(ctx, b.client, b.repo, id)
+	return newBlobWriter(ctx, b.client, b.repo, id, b.uploadLeases, b.unpackPipeline)
 }
 
-// Mount is not supported for simplicity.
-// We could implement cross-repository mounting here by checking if the blob exists and returning its descriptor.
-// However, the content in containerd is not repository-namespaced so checking if a blob exists in a new repository
-// will return true if it exists in the content store, regardless of the repository. Given that, we don't really
-// need the mount operation in this implementation.
+// Mount makes the blob from the source repository available in this repository. The content in containerd is not
+// repository-namespaced so the blob is available in all repositories as soon as it exists in the content store and
+// mounting only needs to check that it exists. This allows the registry to respond with 201 Created to mount requests
+// so that clients skip uploading the blob. Blobs that only exist in peers or the upstream registry aren't mounted.
 func (b *blobStore) Mount(ctx context.Context, sourceRepo reference.Named, dgst digest.Digest) (
 	distribution.Descriptor, error,
 ) {
-	return distribution.Descriptor{}, distribution.ErrUnsupported
+	desc, err := b.statLocal(ctx, dgst)
+	if err != nil {
+		return distribution.Descriptor{}, err
+	}
+	logrus.WithFields(
+		logrus.Fields{
+			"digest": dgst,
+			"from":   sourceRepo.Name(),
+			"repo":   b.repo.Name(),
+		},
+	).Debug("Mounted blob from another repository.")
+
+	return desc, nil
 }
 
-// ServeBlob serves the blob from containerd content store over HTTP.
+// ServeBlob serves the blob from containerd content store over HTTP. It supports range requests (single and
+// multiple ranges) to resume interrupted downloads and conditional requests (If-None-Match, If-Range) based on
+// the digest ETag.
 func (b *blobStore) ServeBlob(ctx context.Context, w http.ResponseWriter, r *http.Request, dgst digest.Digest) error {
 	// Get the blob info to check if it exists and populate the response headers.
-	desc, err := b.Stat(ctx, dgst)
+	desc, err := b.statLocal(ctx, dgst)
+	if err != nil && errors.Is(err, distribution.ErrBlobUnknown) {
+		desc, err = b.statDocker(ctx, dgst)
+	}
+	if err != nil && errors.Is(err, distribution.ErrBlobUnknown) {
+		return b.serveRemote(ctx, w, r, dgst)
+	}
 	if err != nil {
 		return err
 	}
 
-	w.Header().Set("Content-Type", desc.MediaType)
-	w.Header().Set("Content-Length", strconv.FormatInt(desc.Size, 10))
-	w.Header().Set("Docker-Content-Digest", dgst.String())
-	w.Header().Set("Etag", dgst.String())
+	var reader io.ReadSeekCloser
+	if b.contentRoot != "" {
+		// Serving an *os.File allows the kernel to use sendfile to copy the blob to the connection.
+		if reader, err = b.openLocalBlob(desc); err == nil {
+			w = withSendfile(w, r)
+		} else {
+			logrus.WithFields(
+				logrus.Fields{
+					"digest": dgst,
+					"root":   b.contentRoot,
+				},
+			).WithError(err).Debug("Failed to open blob in local content store, falling back to containerd reader.")
+			// Reset the nil *os.File stored in the interface.
+			reader = nil
+		}
+	}
+	if reader == nil {
+		if reader, err = b.Open(ctx, dgst); err != nil {
+			return err
+		}
+	}
+	defer reader.Close()
 
+	setBlobHeaders(w, desc)
+	// ServeContent handles HEAD requests, Range, If-None-Match and If-Range headers, and sets Content-Length and
+	// Accept-Ranges headers.
+	http.ServeContent(w, r, dgst.String(), time.Time{}, reader)
+	return nil
+}
+
+// serveRemote serves the blob missing in the containerd content store from a peer or the upstream registry while
+// storing it. HEAD requests aren't served from remotes as the blob must only be reported as existing once it's stored.
+// Requests with a matching If-None-Match header are answered without fetching the blob, and range requests are served
+// from the containerd content store once the full blob is fetched.
+func (b *blobStore) serveRemote(
+	ctx context.Context, w http.ResponseWriter, r *http.Request, dgst digest.Digest,
+) error {
 	if r.Method == http.MethodHead {
+		return distribution.ErrBlobUnknown
+	}
+	remote, desc, err := b.statRemote(ctx, dgst)
+	if err != nil {
+		return err
+	}
+
+	setBlobHeaders(w, desc)
+	if etagMatches(r.Header.Get("If-None-Match"), desc.Digest) {
+		// The client already has the blob.
+		w.WriteHeader(http.StatusNotModified)
 		return nil
 	}
+	if r.Header.Get("Range") != "" {
+		// Range requests can't be served while the blob is streamed from the remote, so fetch the full blob first and
+		// serve the requested ranges from the containerd content store.
+		if err = remote.fetchBlob(ctx, b.repo, desc); err != nil {
+			return fmt.Errorf("fetch blob '%s' from '%s': %w", dgst, remote.host, err)
+		}
+		return b.ServeBlob(ctx, w, r, dgst)
+	}
+	if err = remote.serveBlob(ctx, w, r, b.repo, desc); err != nil {
+		if errdefs.IsAlreadyExists(err) {
+			// The blob has been stored in the meantime, e.g. by a concurrent request, so serve it locally.
+			return b.ServeBlob(ctx, w, r, dgst)
+		}
+		return fmt.Errorf("serve blob '%s' from '%s': %w", dgst, remote.host, err)
+	}
+	return nil
+}
+
+// setBlobHeaders sets the response headers for serving the blob.
+func setBlobHeaders(w http.ResponseWriter, desc distribution.Descriptor) {
+	w.Header().Set("Content-Type", desc.MediaType)
+	w.Header().Set("Docker-Content-Digest", desc.Digest.String())
+	// The ETag must be a quoted string to be matched against If-None-Match and If-Range by http.ServeContent.
+	w.Header().Set("Etag", strconv.Quote(desc.Digest.String()))
+	// Cache-Control is set the same way as in the default registry blob server as blobs are immutable.
+	w.Header().Set("Cache-Control", "max-age=31536000")
+}
+
+// etagMatches checks if the If-None-Match header value matches the digest ETag of the blob.
+func etagMatches(ifNoneMatch string, dgst digest.Digest) bool {
+	for _, etag := range strings.Split(ifNoneMatch, ",") {
+		etag = strings.TrimPrefix(strings.TrimSpace(etag), "W/")
+		if etag == "*" || etag == strconv.Quote(dgst.String()) {
+			return true
+		}
+	}
+	return false
+}
+
+// openLocalBlob opens the file of the blob in the containerd content store on the local disk.
+func (b *blobStore) openLocalBlob(desc distribution.Descriptor) (*os.File, error) {
+	if err := desc.Digest.Validate(); err != nil {
+		return nil, err
+	}
+	path := filepath.Join(b.contentRoot, "blobs", desc.Digest.Algorithm().String(), desc.Digest.Encoded())
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
 
-	reader, err := b.Open(ctx, dgst)
+	info, err := f.Stat()
 	if err != nil {
-		return err
+		f.Close()
+		return nil, err
+	}
+	// Make sure the file is the committed blob and not something unexpected.
+	if !info.Mode().IsRegular() || info.Size() != desc.Size {
+		f.Close()
+		return nil, fmt.Errorf("unexpected blob file '%s': mode %s, size %d", path, info.Mode(), info.Size())
 	}
-	defer reader.Close()
 
-	_, err = io.CopyN(w, reader, desc.Size)
-	return err
+	return f, nil
 }
 
-// Delete is not supported for simplicity.
-// Deletion can be done by deleting images in containerd, which will clean up the blobs.
+// Delete deletes a blob that isn't referenced by any image from the containerd content store, e.g. a blob left over
+// from an interrupted push. Blobs referenced by images can't be deleted to not break the images. Deleting the images
+// instead cleans up their blobs by containerd garbage collection. If the blob doesn't exist,
+// distribution.ErrBlobUnknown will be returned.
 func (b *blobStore) Delete(ctx context.Context, dgst digest.Digest) error {
-	return distribution.ErrUnsupported
+	contentStore := b.client.ContentStore()
+	if _, err := contentStore.Info(ctx, dgst); err != nil {
+		if errdefs.IsNotFound(err) {
+			return distribution.ErrBlobUnknown
+		}
+		return fmt.Errorf("get metadata for blob '%s' from containerd content store: %w", dgst, err)
+	}
+
+	imgs, err := b.client.ImageService().List(ctx)
+	if err != nil {
+		return fmt.Errorf("list images in containerd image store: %w", err)
+	}
+	for _, img := range imgs {
+		for _, desc := range imageContent(ctx, contentStore, img.Target) {
+			if desc.Digest == dgst {
+				return errcode.ErrorCodeUnsupported.WithDetail(
+					fmt.Sprintf("blob '%s' is referenced by image '%s', delete the image instead", dgst, img.Name),
+				)
+			}
+		}
+	}
+
+	log := logrus.WithFields(
+		logrus.Fields{
+			"digest": dgst,
+			"repo":   b.repo.Name(),
+		},
+	)
+	// The upload leases would keep the blob until they expire if it's garbage collected rather than deleted.
+	for _, lease := range b.uploadLeases.release(requestNamespace(ctx, b.client), []digest.Digest{dgst}) {
+		if err = b.client.LeasesService().Delete(ctx, lease); err != nil && !errdefs.IsNotFound(err) {
+			log.WithField("lease", lease.ID).WithError(err).Warn(
+				"Failed to delete containerd lease used to upload blob.",
+			)
+		}
+	}
+	if err = contentStore.Delete(ctx, dgst); err != nil {
+		if errdefs.IsNotFound(err) {
+			return distribution.ErrBlobUnknown
+		}
+		return fmt.Errorf("delete blob '%s' from containerd content store: %w", dgst, err)
+	}
+	log.Debug("Deleted blob from containerd content store.")
+
+	return nil
 }
 
 // blobReadSeekCloser is an io.ReadSeekCloser that wraps a content.ReaderAt.
@@ -0,0 +1,30 @@
+package containerd
+
+import (
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+)
+
+func TestEtagMatches(t *testing.T) {
+	dgst := digest.FromString("blob")
+	other := digest.FromString("other")
+
+	tests := []struct {
+		ifNoneMatch string
+		want        bool
+	}{
+		{"", false},
+		{`"` + dgst.String() + `"`, true},
+		{`W/"` + dgst.String() + `"`, true},
+		{`"` + other.String() + `", "` + dgst.String() + `"`, true},
+		{`"` + other.String() + `"`, false},
+		{dgst.String(), false},
+		{"*", true},
+	}
+	for _, tt := range tests {
+		if got := etagMatches(tt.ifNoneMatch, dgst); got != tt.want {
+			t.Errorf("etagMatches(%q) = %t, want %t", tt.ifNoneMatch, got, tt.want)
+		}
+	}
+}
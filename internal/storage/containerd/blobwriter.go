@@ -5,6 +5,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"slices"
 	"time"
 
 	"github.com/google/uuid"
@@ -13,6 +14,7 @@ import (
 	"github.com/containerd/containerd/v2/client"
 	"github.com/containerd/containerd/v2/core/content"
 	"github.com/containerd/containerd/v2/core/leases"
+	"github.com/containerd/containerd/v2/pkg/namespaces"
 	"github.com/containerd/errdefs"
 	"github.com/distribution/distribution/v3"
 	"github.com/distribution/reference"
@@ -26,13 +28,22 @@ type blobWriter struct {
 	client *client.Client
 	repo   reference.Named
 	id     string
+	// namespace is the containerd namespace of the request that created the writer. The lease is created in it.
+	namespace string
 
 	// lease is a containerd lease for writer that prevents garbage collection of the content. It's intentionally not
 	// deleted on successful blob commit to keep it while the registry is uploading other blobs and manifests and
 	// creating an image referencing them. Otherwise, the blob would be garbage collected immediately after lease is
 	// deleted if the blob is not referenced by an image.
-	// In the worst case, the lease and unreferenced blob will be garbage collected after leaseExpiration.
-	lease  leases.Lease
+	// The lease is tracked in uploadLeases and deleted by the tag service once an image referencing the blob is
+	// created. In the worst case, the lease and unreferenced blob will be garbage collected after leaseExpiration.
+	lease        leases.Lease
+	uploadLeases *uploadLeases
+	// unpackPipeline is notified about committed blobs to apply layers while the push is still uploading.
+	unpackPipeline *unpackPipeline
+	// hasher computes the diff ID of the blob for the pipeline while it's being uploaded. Nil if the pipeline is
+	// disabled or the upload can't be hashed.
+	hasher *diffIDHasher
 	writer content.Writer
 	// size is the total number of bytes written to writer.
 	size int64
@@ -40,7 +51,12 @@ type blobWriter struct {
 }
 
 func newBlobWriter(
-	ctx context.Context, client *client.Client, repo reference.Named, id string,
+	ctx context.Context,
+	client *client.Client,
+	repo reference.Named,
+	id string,
+	uploadLeases *uploadLeases,
+	unpackPipeline *unpackPipeline,
 ) (distribution.BlobWriter, error) {
 	if id == "" {
 		id = uuid.NewString()
@@ -50,17 +66,21 @@ func newBlobWriter(
 	opts := []leases.Opt{
 		leases.WithRandomID(),
 		leases.WithExpiration(leaseExpiration),
+		// Label the lease so that it can be identified and cleaned up by the reaper if the upload is interrupted.
+		leases.WithLabel(uploadLeaseLabel, id),
 	}
 	lease, err := client.LeasesService().Create(ctx, opts...)
 	if err != nil {
 		return nil, fmt.Errorf("create containerd lease: %w", err)
 	}
+	uploadLeases.add(id, lease)
 
 	// Open a containerd content writer with the lease.
 	ctx = leases.WithLease(ctx, lease.ID)
-	writer, err := content.OpenWriter(ctx, client.ContentStore(), content.WithRef("upload-"+id))
+	writer, err := content.OpenWriter(ctx, client.ContentStore(), content.WithRef(uploadRefPrefix+id))
 	if err != nil {
 		_ = client.LeasesService().Delete(ctx, lease)
+		uploadLeases.remove(id, lease)
 		return nil, fmt.Errorf("create containerd content writer: %w", err)
 	}
 
@@ -79,13 +99,17 @@ func newBlobWriter(
 	log.WithField("size", status.Offset).Debug("Created new containerd blob writer.")
 
 	return &blobWriter{
-		client: client,
-		repo:   repo,
-		id:     id,
-		lease:  lease,
-		writer: writer,
-		size:   status.Offset,
-		log:    log,
+		client:         client,
+		repo:           repo,
+		id:             id,
+		namespace:      requestNamespace(ctx, client),
+		lease:          lease,
+		uploadLeases:   uploadLeases,
+		unpackPipeline: unpackPipeline,
+		hasher:         unpackPipeline.hasher(id, status.Offset),
+		writer:         writer,
+		size:           status.Offset,
+		log:            log,
 	}, nil
 }
 
@@ -106,6 +130,9 @@ func (bw *blobWriter) Size() int64 {
 
 // ReadFrom reads from the provided reader and writes to the containerd blob writer.
 func (bw *blobWriter) ReadFrom(r io.Reader) (int64, error) {
+	if bw.hasher != nil {
+		r = io.TeeReader(r, bw.hasher)
+	}
 	n, err := io.Copy(bw.writer, r)
 	bw.size += n
 
@@ -123,6 +150,7 @@ func (bw *blobWriter) ReadFrom(r io.Reader) (int64, error) {
 func (bw *blobWriter) Write(data []byte) (int, error) {
 	n, err := bw.writer.Write(data)
 	bw.size += int64(n)
+	_, _ = bw.hasher.Write(data[:n])
 
 	log := bw.log.WithField("size", n)
 	if err != nil {
@@ -147,16 +175,35 @@ func (bw *blobWriter) Commit(ctx context.Context, desc distribution.Descriptor)
 	log.Debug("Committing blob to containerd content store.")
 	// The caller may not provide a size in the descriptor if it doesn't know it so we use the calculated size from
 	// the writer.
-	if err := bw.writer.Commit(ctx, bw.size, desc.Digest); err != nil {
-		// The writer didn't create a new blob so we don't need to keep the lease.
-		_ = bw.client.LeasesService().Delete(ctx, bw.lease)
+	var opts []content.Opt
+	if desc.MediaType != "" {
+		opts = append(opts, content.WithLabels(map[string]string{mediaTypeLabel: desc.MediaType}))
+	}
+	if err := bw.writer.Commit(ctx, bw.size, desc.Digest, opts...); err != nil {
+		// The writer didn't create a new blob so we don't need to keep the leases of the upload session.
+		bw.deleteSessionLeases(ctx)
+		bw.unpackPipeline.discard(bw.id)
 
 		if errdefs.IsAlreadyExists(err) {
 			log.Debug("Blob already exists in containerd content store.")
+			// The existing blob may have been stored without a media type, e.g. pulled by containerd.
+			if desc.MediaType != "" {
+				info := content.Info{
+					Digest: desc.Digest,
+					Labels: map[string]string{mediaTypeLabel: desc.MediaType},
+				}
+				if _, err = bw.client.ContentStore().Update(ctx, info, "labels."+mediaTypeLabel); err != nil {
+					return distribution.Descriptor{}, fmt.Errorf(
+						"set media type label for blob '%s' in containerd content store: %w", desc.Digest, err,
+					)
+				}
+			}
 		} else {
 			return distribution.Descriptor{}, fmt.Errorf("commit blob to containerd content store: %w", err)
 		}
 	} else {
+		bw.uploadLeases.commit(bw.namespace, bw.id, desc.Digest)
+		bw.unpackPipeline.committed(bw.namespace, bw.id, desc.Digest, bw.size)
 		log.Debug("Successfully committed blob to containerd content store.")
 	}
 
@@ -165,16 +212,17 @@ func (bw *blobWriter) Commit(ctx context.Context, desc distribution.Descriptor)
 	}
 	if desc.MediaType == "" {
 		// Not sure if this is needed but the default registry blob writer assigns this.
-		desc.MediaType = "application/octet-stream"
+		desc.MediaType = defaultMediaType
 	}
 
 	return desc, nil
 }
 
-// Cancel cancels the blob upload by deleting the containerd lease.
+// Cancel cancels the blob upload by deleting the containerd leases of the upload session.
 func (bw *blobWriter) Cancel(ctx context.Context) error {
-	bw.log.Debug("Canceling upload: deleting containerd lease.")
-	return bw.client.LeasesService().Delete(ctx, bw.lease)
+	bw.log.Debug("Canceling upload: deleting containerd leases.")
+	bw.unpackPipeline.discard(bw.id)
+	return bw.deleteSessionLeases(ctx)
 }
 
 // Close closes the containerd blob writer.
@@ -183,9 +231,31 @@ func (bw *blobWriter) Close() error {
 	err := bw.writer.Close()
 
 	if bw.size == 0 {
-		// It's safe to delete the lease if no data was written to the writer. Deletion is idempotent.
-		err = errors.Join(bw.client.LeasesService().Delete(context.Background(), bw.lease))
+		// It's safe to delete the lease if no data was written to the writer. The request context may already be
+		// canceled so the lease is deleted in the namespace it was created in with a new context.
+		ctx := namespaces.WithNamespace(context.Background(), bw.namespace)
+		if dErr := bw.client.LeasesService().Delete(ctx, bw.lease); dErr != nil && !errdefs.IsNotFound(dErr) {
+			// Keep tracking the lease so that it's deleted with the session leases or expires.
+			return errors.Join(err, fmt.Errorf("delete containerd lease '%s': %w", bw.lease.ID, dErr))
+		}
+		bw.uploadLeases.remove(bw.id, bw.lease)
+	}
+
+	return err
+}
+
+// deleteSessionLeases deletes all the containerd leases created for the upload session including the writer's lease.
+func (bw *blobWriter) deleteSessionLeases(ctx context.Context) error {
+	sessionLeases := bw.uploadLeases.removeSession(bw.id)
+	if !slices.ContainsFunc(sessionLeases, func(l leases.Lease) bool { return l.ID == bw.lease.ID }) {
+		sessionLeases = append(sessionLeases, bw.lease)
 	}
 
+	var err error
+	for _, lease := range sessionLeases {
+		if dErr := bw.client.LeasesService().Delete(ctx, lease); dErr != nil && !errdefs.IsNotFound(dErr) {
+			err = errors.Join(err, fmt.Errorf("delete containerd lease '%s': %w", lease.ID, dErr))
+		}
+	}
 	return err
 }
@@ -0,0 +1,219 @@
+package containerd
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"path"
+
+	"github.com/containerd/containerd/v2/core/content"
+	"github.com/containerd/containerd/v2/core/images"
+	"github.com/containerd/platforms"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/sirupsen/logrus"
+)
+
+// dockerLoader loads images from the containerd content store into the classic Docker image store (when Docker
+// doesn't use the containerd image store) through the Docker Engine API. The image is streamed in the docker save
+// format to the /images/load endpoint so that it doesn't have to be pulled from the registry and stored twice.
+type dockerLoader struct {
+	client *http.Client
+	// platform selects the image manifest to load from an image index as the classic image store only supports
+	// single-platform images.
+	platform platforms.MatchComparer
+	// deleteImage deletes the image from the containerd image store once it's loaded into Docker.
+	deleteImage bool
+}
+
+// dockerArchiveManifest is an entry in the manifest.json file of a docker save archive.
+type dockerArchiveManifest struct {
+	Config   string
+	RepoTags []string
+	Layers   []string
+}
+
+// dockerLoadMessage is a message in the JSON stream returned by the Docker Engine API /images/load endpoint.
+type dockerLoadMessage struct {
+	Stream      string `json:"stream,omitempty"`
+	Error       string `json:"error,omitempty"`
+	ErrorDetail *struct {
+		Message string `json:"message"`
+	} `json:"errorDetail,omitempty"`
+}
+
+// newDockerLoader creates a dockerLoader that connects to the Docker Engine API over the given unix socket.
+func newDockerLoader(sock string, deleteImage bool) (*dockerLoader, error) {
+	if sock == "" {
+		return nil, fmt.Errorf("docker socket path is required to load images into Docker")
+	}
+
+	return &dockerLoader{
+		client:      newDockerHTTPClient(sock),
+		platform:    platforms.Default(),
+		deleteImage: deleteImage,
+	}, nil
+}
+
+// newDockerHTTPClient creates an HTTP client for the Docker Engine API that connects over the given unix socket.
+// The host in request URLs is ignored.
+func newDockerHTTPClient(sock string) *http.Client {
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", sock)
+		},
+	}
+	return &http.Client{Transport: transport}
+}
+
+// dockerAPIError returns the error message from a failed Docker Engine API response.
+func dockerAPIError(resp *http.Response) error {
+	var apiErr struct {
+		Message string `json:"message"`
+	}
+	body, _ := io.ReadAll(resp.Body)
+	if json.Unmarshal(body, &apiErr) != nil || apiErr.Message == "" {
+		apiErr.Message = string(body)
+	}
+	return fmt.Errorf("%s: %s", resp.Status, apiErr.Message)
+}
+
+// load streams the image from the content provider into Docker tagged with the given repository tag,
+// e.g. "myapp:latest".
+func (l *dockerLoader) load(ctx context.Context, provider content.Provider, img images.Image, repoTag string) error {
+	manifest, err := images.Manifest(ctx, provider, img.Target, l.platform)
+	if err != nil {
+		return fmt.Errorf(
+			"get manifest of image '%s' for platform '%s': %w", img.Name, platforms.DefaultString(), err,
+		)
+	}
+
+	pr, pw := io.Pipe()
+	// Closing the reader stops writing the archive if the request fails before the whole archive is sent.
+	defer pr.Close()
+	go func() {
+		pw.CloseWithError(writeDockerArchive(ctx, pw, provider, manifest, repoTag))
+	}()
+
+	// The host is ignored as the connection is made over the unix socket.
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "http://docker/images/load?quiet=1", pr)
+	if err != nil {
+		return fmt.Errorf("create docker load request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/x-tar")
+
+	resp, err := l.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("load image '%s' into docker: %w", img.Name, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("load image '%s' into docker: %w", img.Name, dockerAPIError(resp))
+	}
+
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		var msg dockerLoadMessage
+		if err = decoder.Decode(&msg); err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			return fmt.Errorf("read docker load response for image '%s': %w", img.Name, err)
+		}
+		if msg.ErrorDetail != nil && msg.ErrorDetail.Message != "" {
+			return fmt.Errorf("load image '%s' into docker: %s", img.Name, msg.ErrorDetail.Message)
+		}
+		if msg.Error != "" {
+			return fmt.Errorf("load image '%s' into docker: %s", img.Name, msg.Error)
+		}
+		if msg.Stream != "" {
+			logrus.WithField("image", img.Name).Debugf("Docker load: %s", msg.Stream)
+		}
+	}
+
+	logrus.WithFields(
+		logrus.Fields{
+			"image":  img.Name,
+			"tag":    repoTag,
+			"config": manifest.Config.Digest,
+		},
+	).Info("Loaded image into Docker.")
+	return nil
+}
+
+// writeDockerArchive writes the image with the given manifest in the docker save format to w. The layers are written
+// as they're stored in the content store as Docker decompresses them on load.
+func writeDockerArchive(
+	ctx context.Context, w io.Writer, provider content.Provider, manifest ocispec.Manifest, repoTag string,
+) error {
+	tw := tar.NewWriter(w)
+
+	archiveManifest := dockerArchiveManifest{
+		Config:   blobArchivePath(manifest.Config),
+		RepoTags: []string{repoTag},
+	}
+	if err := writeArchiveBlob(ctx, tw, provider, manifest.Config); err != nil {
+		return err
+	}
+	for _, layer := range manifest.Layers {
+		if !images.IsLayerType(layer.MediaType) {
+			continue
+		}
+		if err := writeArchiveBlob(ctx, tw, provider, layer); err != nil {
+			return err
+		}
+		archiveManifest.Layers = append(archiveManifest.Layers, blobArchivePath(layer))
+	}
+
+	manifestJSON, err := json.Marshal([]dockerArchiveManifest{archiveManifest})
+	if err != nil {
+		return fmt.Errorf("marshal docker archive manifest: %w", err)
+	}
+	if err = tw.WriteHeader(&tar.Header{
+		Name:     "manifest.json",
+		Mode:     0o644,
+		Size:     int64(len(manifestJSON)),
+		Typeflag: tar.TypeReg,
+	}); err != nil {
+		return fmt.Errorf("write docker archive manifest: %w", err)
+	}
+	if _, err = tw.Write(manifestJSON); err != nil {
+		return fmt.Errorf("write docker archive manifest: %w", err)
+	}
+
+	return tw.Close()
+}
+
+// blobArchivePath returns the path of the blob in a docker save archive using the OCI image layout convention.
+func blobArchivePath(desc ocispec.Descriptor) string {
+	return path.Join("blobs", desc.Digest.Algorithm().String(), desc.Digest.Encoded())
+}
+
+// writeArchiveBlob writes the blob from the content provider as a file to the tar archive.
+func writeArchiveBlob(ctx context.Context, tw *tar.Writer, provider content.Provider, desc ocispec.Descriptor) error {
+	ra, err := provider.ReaderAt(ctx, desc)
+	if err != nil {
+		return fmt.Errorf("open blob '%s' from containerd content store: %w", desc.Digest, err)
+	}
+	defer ra.Close()
+
+	if err = tw.WriteHeader(&tar.Header{
+		Name:     blobArchivePath(desc),
+		Mode:     0o644,
+		Size:     ra.Size(),
+		Typeflag: tar.TypeReg,
+	}); err != nil {
+		return fmt.Errorf("write blob '%s' to docker archive: %w", desc.Digest, err)
+	}
+	if _, err = io.Copy(tw, content.NewReader(ra)); err != nil {
+		return fmt.Errorf("write blob '%s' to docker archive: %w", desc.Digest, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,206 @@
+package containerd
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/containerd/containerd/v2/core/content"
+	"github.com/containerd/containerd/v2/core/images"
+	"github.com/containerd/containerd/v2/plugins/content/local"
+	"github.com/containerd/platforms"
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// fakeDockerAPI is a fake Docker Engine API server that serves /images/load over a unix socket.
+type fakeDockerAPI struct {
+	sock string
+	// files are the files of the last loaded archive by their paths.
+	files map[string][]byte
+	// response is the JSON stream returned by /images/load.
+	response string
+}
+
+func newFakeDockerAPI(t *testing.T, response string) *fakeDockerAPI {
+	t.Helper()
+
+	api := &fakeDockerAPI{response: response}
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /images/load", func(w http.ResponseWriter, r *http.Request) {
+		if ct := r.Header.Get("Content-Type"); ct != "application/x-tar" {
+			http.Error(w, `{"message":"unexpected content type"}`, http.StatusBadRequest)
+			return
+		}
+
+		api.files = make(map[string][]byte)
+		tr := tar.NewReader(r.Body)
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				http.Error(w, `{"message":"invalid tar archive"}`, http.StatusBadRequest)
+				return
+			}
+			data, _ := io.ReadAll(tr)
+			api.files[hdr.Name] = data
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = io.WriteString(w, api.response)
+	})
+
+	api.sock = serveUnixSocket(t, mux)
+
+	return api
+}
+
+// serveUnixSocket serves the handler over a unix socket in a temporary directory and returns the socket path.
+func serveUnixSocket(t *testing.T, handler http.Handler) string {
+	t.Helper()
+
+	sock := filepath.Join(t.TempDir(), "docker.sock")
+	listener, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatalf("listen on unix socket: %v", err)
+	}
+	server := &http.Server{Handler: handler}
+	go func() { _ = server.Serve(listener) }()
+	t.Cleanup(func() { _ = server.Close() })
+
+	return sock
+}
+
+// writeTestImage writes a single-layer image for the host platform to the content store.
+func writeTestImage(t *testing.T, ctx context.Context, cs content.Store) (images.Image, []byte, []byte) {
+	t.Helper()
+
+	var layerTar bytes.Buffer
+	tw := tar.NewWriter(&layerTar)
+	fileContent := []byte("hello from unregistry\n")
+	_ = tw.WriteHeader(&tar.Header{Name: "hello.txt", Mode: 0o644, Size: int64(len(fileContent))})
+	_, _ = tw.Write(fileContent)
+	_ = tw.Close()
+
+	var layer bytes.Buffer
+	gw := gzip.NewWriter(&layer)
+	_, _ = gw.Write(layerTar.Bytes())
+	_ = gw.Close()
+
+	config, err := json.Marshal(ocispec.Image{
+		Platform: platforms.DefaultSpec(),
+		RootFS: ocispec.RootFS{
+			Type:    "layers",
+			DiffIDs: []digest.Digest{digest.FromBytes(layerTar.Bytes())},
+		},
+	})
+	if err != nil {
+		t.Fatalf("marshal config: %v", err)
+	}
+
+	configDesc := writeTestBlob(t, ctx, cs, ocispec.MediaTypeImageConfig, config)
+	layerDesc := writeTestBlob(t, ctx, cs, ocispec.MediaTypeImageLayerGzip, layer.Bytes())
+	manifest, err := json.Marshal(ocispec.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ocispec.MediaTypeImageManifest,
+		Config:    configDesc,
+		Layers:    []ocispec.Descriptor{layerDesc},
+	})
+	if err != nil {
+		t.Fatalf("marshal manifest: %v", err)
+	}
+	manifestDesc := writeTestBlob(t, ctx, cs, ocispec.MediaTypeImageManifest, manifest)
+
+	img := images.Image{
+		Name:   "docker.io/library/myapp:latest",
+		Target: manifestDesc,
+	}
+	return img, config, layer.Bytes()
+}
+
+func writeTestBlob(
+	t *testing.T, ctx context.Context, cs content.Store, mediaType string, blob []byte,
+) ocispec.Descriptor {
+	t.Helper()
+
+	desc := ocispec.Descriptor{
+		MediaType: mediaType,
+		Digest:    digest.FromBytes(blob),
+		Size:      int64(len(blob)),
+	}
+	if err := content.WriteBlob(ctx, cs, desc.Digest.String(), bytes.NewReader(blob), desc); err != nil {
+		t.Fatalf("write blob: %v", err)
+	}
+	return desc
+}
+
+func TestDockerLoaderLoad(t *testing.T) {
+	ctx := context.Background()
+	cs, err := local.NewStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("create content store: %v", err)
+	}
+	img, config, layer := writeTestImage(t, ctx, cs)
+
+	api := newFakeDockerAPI(t, `{"stream":"Loaded image: myapp:latest\n"}`)
+	loader, err := newDockerLoader(api.sock, false)
+	if err != nil {
+		t.Fatalf("create docker loader: %v", err)
+	}
+
+	if err = loader.load(ctx, cs, img, "myapp:latest"); err != nil {
+		t.Fatalf("load image: %v", err)
+	}
+
+	var archiveManifest []dockerArchiveManifest
+	if err = json.Unmarshal(api.files["manifest.json"], &archiveManifest); err != nil {
+		t.Fatalf("unmarshal archive manifest.json: %v", err)
+	}
+	if len(archiveManifest) != 1 {
+		t.Fatalf("expected 1 image in archive manifest.json, got %d", len(archiveManifest))
+	}
+	m := archiveManifest[0]
+	if len(m.RepoTags) != 1 || m.RepoTags[0] != "myapp:latest" {
+		t.Errorf("expected repo tags [myapp:latest], got %v", m.RepoTags)
+	}
+	if !bytes.Equal(api.files[m.Config], config) {
+		t.Errorf("config %q in archive doesn't match the image config", m.Config)
+	}
+	if len(m.Layers) != 1 {
+		t.Fatalf("expected 1 layer in archive manifest.json, got %d", len(m.Layers))
+	}
+	if !bytes.Equal(api.files[m.Layers[0]], layer) {
+		t.Errorf("layer %q in archive doesn't match the image layer", m.Layers[0])
+	}
+}
+
+func TestDockerLoaderLoadError(t *testing.T) {
+	ctx := context.Background()
+	cs, err := local.NewStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("create content store: %v", err)
+	}
+	img, _, _ := writeTestImage(t, ctx, cs)
+
+	api := newFakeDockerAPI(t, `{"errorDetail":{"message":"no space left on device"},"error":"no space left on device"}`)
+	loader, err := newDockerLoader(api.sock, false)
+	if err != nil {
+		t.Fatalf("create docker loader: %v", err)
+	}
+
+	err = loader.load(ctx, cs, img, "myapp:latest")
+	if err == nil || !strings.Contains(err.Error(), "no space left on device") {
+		t.Fatalf("expected load error with docker error message, got %v", err)
+	}
+}
@@ -0,0 +1,186 @@
+package containerd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+
+	"github.com/containerd/containerd/v2/client"
+	"github.com/containerd/containerd/v2/core/images"
+	"github.com/containerd/errdefs"
+	"github.com/distribution/reference"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sync/singleflight"
+)
+
+// dockerSourceLabel is the label set on images imported from the classic Docker image store.
+const dockerSourceLabel = "unregistry.io/source"
+
+// dockerSource imports images from the classic Docker image store (when Docker doesn't use the containerd image
+// store) into containerd on demand so that images built or loaded into Docker can be pulled from the registry.
+// The image is exported from Docker through the Docker Engine API in the docker save format and imported into
+// the containerd content and image stores to be served through the normal registry API.
+type dockerSource struct {
+	client     *client.Client
+	imageStore images.Store
+	httpClient *http.Client
+	// importFunc imports the images in the docker save archive into containerd.
+	importFunc func(ctx context.Context, archive io.Reader) ([]images.Image, error)
+	// imports deduplicates concurrent imports of the same image and lookups of the same repository in the same
+	// namespace so that they don't export it from Docker multiple times. Imports of different images run concurrently.
+	imports singleflight.Group
+}
+
+func newDockerSource(cli *client.Client, sock string) (*dockerSource, error) {
+	if sock == "" {
+		return nil, fmt.Errorf("docker socket path is required to serve images from Docker")
+	}
+
+	return &dockerSource{
+		client:     cli,
+		imageStore: cli.ImageService(),
+		httpClient: newDockerHTTPClient(sock),
+		importFunc: func(ctx context.Context, archive io.Reader) ([]images.Image, error) {
+			return cli.Import(
+				ctx, archive,
+				// Docker may store images for a platform other than the host one.
+				client.WithAllPlatforms(true),
+				// Layers in the legacy docker save format are uncompressed so compress them to reduce the pull size.
+				client.WithImportCompression(),
+				client.WithImageLabels(map[string]string{dockerSourceLabel: "docker"}),
+			)
+		},
+	}, nil
+}
+
+// importImage exports the image with the given reference from Docker and imports it into containerd. It returns
+// false if the image doesn't exist in Docker. Concurrent imports of the same image into the same namespace share
+// a single export.
+func (s *dockerSource) importImage(ctx context.Context, ref reference.NamedTagged) (bool, error) {
+	// The import continues for the other callers waiting for it if the caller that started it goes away.
+	key := "image " + requestNamespace(ctx, s.client) + "/" + ref.String()
+	imported, err, _ := s.imports.Do(key, func() (any, error) {
+		return s.doImportImage(context.WithoutCancel(ctx), ref)
+	})
+	if err != nil {
+		return false, err
+	}
+	return imported.(bool), nil
+}
+
+func (s *dockerSource) doImportImage(ctx context.Context, ref reference.NamedTagged) (bool, error) {
+	// The image may have been imported by a request that has just finished.
+	if _, err := s.imageStore.Get(ctx, ref.String()); err == nil {
+		return true, nil
+	} else if !errdefs.IsNotFound(err) {
+		return false, fmt.Errorf("get image '%s' from containerd image store: %w", ref.String(), err)
+	}
+
+	name := reference.FamiliarString(ref)
+	log := logrus.WithField("image", name)
+	// The host is ignored as the connection is made over the unix socket.
+	req, err := http.NewRequestWithContext(
+		ctx, http.MethodGet, "http://docker/images/get?names="+url.QueryEscape(name), nil,
+	)
+	if err != nil {
+		return false, fmt.Errorf("create docker export request: %w", err)
+	}
+
+	resp, err := s.httpClient.Do(req)
+	if err != nil {
+		return false, fmt.Errorf("export image '%s' from docker: %w", name, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		log.Debug("Image not found in Docker.")
+		return false, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("export image '%s' from docker: %w", name, dockerAPIError(resp))
+	}
+
+	log.Debug("Importing image from Docker into containerd.")
+	imgs, err := s.importFunc(ctx, resp.Body)
+	if err != nil {
+		return false, fmt.Errorf("import image '%s' from docker into containerd: %w", name, err)
+	}
+
+	for _, img := range imgs {
+		if img.Name == ref.String() {
+			log.WithField("descriptor", img.Target).Info("Imported image from Docker into containerd.")
+			return true, nil
+		}
+	}
+	log.Warn("Image exported from Docker doesn't contain the requested tag.")
+	return false, nil
+}
+
+// importRepository imports the tags of the repository that exist in Docker but not in containerd. It's used to find
+// blobs and manifests requested by digest, e.g. when a client pulls "myapp@sha256:..." of an image only Docker has.
+// It returns true if any image has been imported.
+func (s *dockerSource) importRepository(ctx context.Context, repo reference.Named) (bool, error) {
+	key := "repository " + requestNamespace(ctx, s.client) + "/" + repo.Name()
+	imported, err, _ := s.imports.Do(key, func() (any, error) {
+		return s.doImportRepository(context.WithoutCancel(ctx), repo)
+	})
+	if err != nil {
+		return false, err
+	}
+	return imported.(bool), nil
+}
+
+func (s *dockerSource) doImportRepository(ctx context.Context, repo reference.Named) (bool, error) {
+	name := reference.FamiliarName(repo)
+	filters, err := json.Marshal(map[string][]string{"reference": {name}})
+	if err != nil {
+		return false, fmt.Errorf("encode docker image filters: %w", err)
+	}
+	req, err := http.NewRequestWithContext(
+		ctx, http.MethodGet, "http://docker/images/json?filters="+url.QueryEscape(string(filters)), nil,
+	)
+	if err != nil {
+		return false, fmt.Errorf("create docker image list request: %w", err)
+	}
+
+	resp, err := s.httpClient.Do(req)
+	if err != nil {
+		return false, fmt.Errorf("list images of repository '%s' in docker: %w", name, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("list images of repository '%s' in docker: %w", name, dockerAPIError(resp))
+	}
+	var summaries []struct {
+		RepoTags []string `json:"RepoTags"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&summaries); err != nil {
+		return false, fmt.Errorf("decode docker image list of repository '%s': %w", name, err)
+	}
+
+	var imported bool
+	for _, summary := range summaries {
+		for _, repoTag := range summary.RepoTags {
+			ref, err := reference.ParseNormalizedNamed(repoTag)
+			if err != nil {
+				continue
+			}
+			tagged, ok := ref.(reference.NamedTagged)
+			if !ok || tagged.Name() != repo.Name() {
+				continue
+			}
+			if _, err = s.imageStore.Get(ctx, tagged.String()); err == nil {
+				continue
+			}
+			ok, err = s.importImage(ctx, tagged)
+			if err != nil {
+				return imported, err
+			}
+			imported = imported || ok
+		}
+	}
+	return imported, nil
+}
@@ -0,0 +1,251 @@
+package containerd
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/containerd/containerd/v2/core/images"
+	"github.com/containerd/containerd/v2/pkg/namespaces"
+	"github.com/distribution/reference"
+)
+
+// newTestDockerSource returns a dockerSource that connects to the fake Docker API handler and imports the exported
+// images into the image store. The export archive of the fake API is the familiar image name and the import creates
+// the image with that name. It returns the names of the exported images.
+func newTestDockerSource(t *testing.T, handler http.Handler, imageStore images.Store) (*dockerSource, func() []string) {
+	t.Helper()
+
+	var mu sync.Mutex
+	var exported []string
+	source := &dockerSource{
+		imageStore: imageStore,
+		httpClient: newDockerHTTPClient(serveUnixSocket(t, handler)),
+		importFunc: func(ctx context.Context, archive io.Reader) ([]images.Image, error) {
+			data, err := io.ReadAll(archive)
+			if err != nil {
+				return nil, err
+			}
+			ref, err := reference.ParseNormalizedNamed(string(data))
+			if err != nil {
+				return nil, err
+			}
+			mu.Lock()
+			exported = append(exported, string(data))
+			mu.Unlock()
+			img, err := imageStore.Create(ctx, images.Image{Name: ref.String()})
+			return []images.Image{img}, err
+		},
+	}
+	return source, func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		sort.Strings(exported)
+		return exported
+	}
+}
+
+// exportHandler serves the familiar image name as the docker save archive of the images in the given list.
+func exportHandler(available ...string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := r.URL.Query().Get("names")
+		for _, a := range available {
+			if a == name {
+				_, _ = io.WriteString(w, name)
+				return
+			}
+		}
+		http.Error(w, `{"message":"No such image: `+name+`"}`, http.StatusNotFound)
+	}
+}
+
+// namespacedImageStore is an images.Store that keeps the images of each containerd namespace in a separate store.
+type namespacedImageStore struct {
+	images.Store
+	mu     sync.Mutex
+	stores map[string]*fakeImageStore
+}
+
+func (s *namespacedImageStore) store(ctx context.Context) *fakeImageStore {
+	ns, _ := namespaces.Namespace(ctx)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stores[ns] == nil {
+		s.stores[ns] = newFakeImageStore()
+	}
+	return s.stores[ns]
+}
+
+func (s *namespacedImageStore) Get(ctx context.Context, name string) (images.Image, error) {
+	return s.store(ctx).Get(ctx, name)
+}
+
+func (s *namespacedImageStore) Create(ctx context.Context, img images.Image) (images.Image, error) {
+	return s.store(ctx).Create(ctx, img)
+}
+
+func mustParseTagged(t *testing.T, name string) reference.NamedTagged {
+	t.Helper()
+	ref, err := reference.ParseNormalizedNamed(name)
+	if err != nil {
+		t.Fatalf("parse reference %q: %v", name, err)
+	}
+	tagged, ok := ref.(reference.NamedTagged)
+	if !ok {
+		t.Fatalf("reference %q is not tagged", name)
+	}
+	return tagged
+}
+
+func TestDockerSourceImportImage(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.Handle("GET /images/get", exportHandler("myapp:latest"))
+	source, exported := newTestDockerSource(t, mux, newFakeImageStore())
+	ref := mustParseTagged(t, "myapp:latest")
+	ctx := namespaces.WithNamespace(context.Background(), "default")
+
+	// Concurrent pulls of the same image export it from Docker once.
+	var wg sync.WaitGroup
+	for range 5 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if imported, err := source.importImage(ctx, ref); err != nil || !imported {
+				t.Errorf("import image: imported = %t, err = %v", imported, err)
+			}
+		}()
+	}
+	wg.Wait()
+	if got := exported(); len(got) != 1 {
+		t.Errorf("expected the image to be exported once, got %v", got)
+	}
+
+	imported, err := source.importImage(ctx, mustParseTagged(t, "missing:latest"))
+	if err != nil || imported {
+		t.Errorf("missing image: imported = %t, err = %v", imported, err)
+	}
+}
+
+func TestDockerSourceImportsDifferentImagesConcurrently(t *testing.T) {
+	exportingB := make(chan struct{})
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /images/get", func(w http.ResponseWriter, r *http.Request) {
+		name := r.URL.Query().Get("names")
+		if name == "b:latest" {
+			close(exportingB)
+		} else {
+			// The export of "a" only finishes once "b" is being exported, i.e. imports aren't serialized.
+			select {
+			case <-exportingB:
+			case <-time.After(5 * time.Second):
+				http.Error(w, `{"message":"timeout"}`, http.StatusInternalServerError)
+				return
+			}
+		}
+		_, _ = io.WriteString(w, name)
+	})
+	source, _ := newTestDockerSource(t, mux, newFakeImageStore())
+	ctx := namespaces.WithNamespace(context.Background(), "default")
+
+	var wg sync.WaitGroup
+	for _, name := range []string{"a:latest", "b:latest"} {
+		ref := mustParseTagged(t, name)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if imported, err := source.importImage(ctx, ref); err != nil || !imported {
+				t.Errorf("import image %s: imported = %t, err = %v", ref, imported, err)
+			}
+		}()
+		if name == "a:latest" {
+			// Let the import of "a" start first.
+			time.Sleep(50 * time.Millisecond)
+		}
+	}
+	wg.Wait()
+}
+
+func TestDockerSourceImportsIntoNamespacesSeparately(t *testing.T) {
+	var mu sync.Mutex
+	requests := 0
+	bothExporting := make(chan struct{})
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /images/get", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		if requests++; requests == 2 {
+			close(bothExporting)
+		}
+		mu.Unlock()
+		// The export only finishes once the image is being exported for both namespaces, i.e. the concurrent imports
+		// of the same image into different namespaces aren't shared.
+		select {
+		case <-bothExporting:
+		case <-time.After(5 * time.Second):
+			http.Error(w, `{"message":"timeout"}`, http.StatusInternalServerError)
+			return
+		}
+		_, _ = io.WriteString(w, r.URL.Query().Get("names"))
+	})
+	imageStore := &namespacedImageStore{stores: make(map[string]*fakeImageStore)}
+	source, exported := newTestDockerSource(t, mux, imageStore)
+	ref := mustParseTagged(t, "myapp:latest")
+
+	var wg sync.WaitGroup
+	for _, ns := range []string{"moby", "k8s.io"} {
+		ctx := namespaces.WithNamespace(context.Background(), ns)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if imported, err := source.importImage(ctx, ref); err != nil || !imported {
+				t.Errorf("import image into namespace %s: imported = %t, err = %v", ns, imported, err)
+			}
+		}()
+	}
+	wg.Wait()
+	if got := exported(); len(got) != 2 {
+		t.Errorf("expected the image to be exported for each namespace, got %v", got)
+	}
+}
+
+func TestDockerSourceImportRepository(t *testing.T) {
+	var filters string
+	mux := http.NewServeMux()
+	mux.Handle("GET /images/get", exportHandler("myapp:latest", "myapp:v1", "myapp:v2", "other:latest"))
+	mux.HandleFunc("GET /images/json", func(w http.ResponseWriter, r *http.Request) {
+		filters = r.URL.Query().Get("filters")
+		_ = json.NewEncoder(w).Encode([]map[string][]string{
+			{"RepoTags": {"myapp:latest", "myapp:v1", "other:latest"}},
+			{"RepoTags": {"myapp:v2"}},
+			{"RepoTags": {}},
+		})
+	})
+	imageStore := newFakeImageStore(images.Image{Name: "docker.io/library/myapp:v1"})
+	source, exported := newTestDockerSource(t, mux, imageStore)
+	repo, err := reference.ParseNormalizedNamed("myapp")
+	if err != nil {
+		t.Fatalf("parse repository name: %v", err)
+	}
+	ctx := namespaces.WithNamespace(context.Background(), "default")
+
+	imported, err := source.importRepository(ctx, repo)
+	if err != nil || !imported {
+		t.Fatalf("import repository: imported = %t, err = %v", imported, err)
+	}
+	if filters != `{"reference":["myapp"]}` {
+		t.Errorf("unexpected image list filters: %s", filters)
+	}
+	// Only the tags of the repository missing in containerd are imported.
+	if got := exported(); len(got) != 2 || got[0] != "myapp:latest" || got[1] != "myapp:v2" {
+		t.Errorf("expected myapp:latest and myapp:v2 to be exported, got %v", got)
+	}
+
+	// Nothing is imported once all the tags exist in containerd.
+	if imported, err = source.importRepository(ctx, repo); err != nil || imported {
+		t.Errorf("second import: imported = %t, err = %v", imported, err)
+	}
+}
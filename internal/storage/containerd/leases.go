@@ -0,0 +1,108 @@
+package containerd
+
+import (
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/containerd/containerd/v2/core/leases"
+	"github.com/opencontainers/go-digest"
+)
+
+// uploadLeases keeps track of containerd leases created by blob writers to upload content. It's shared between
+// the blob writers and tag service so that the leases can be deleted once the uploaded content is referenced by
+// an image and protected from garbage collection by its labels. Leases for content that is never referenced by
+// an image are not deleted explicitly and expire after leaseExpiration.
+type uploadLeases struct {
+	mu sync.Mutex
+	// sessions maps upload session IDs to the leases created by blob writers for the session. A resumable upload
+	// session may create multiple leases, one per blob writer instance.
+	sessions map[string][]leases.Lease
+	// blobs maps digests of committed blobs in their namespaces to the leases that were used to upload them.
+	blobs map[namespacedDigest][]leases.Lease
+}
+
+func newUploadLeases() *uploadLeases {
+	return &uploadLeases{
+		sessions: make(map[string][]leases.Lease),
+		blobs:    make(map[namespacedDigest][]leases.Lease),
+	}
+}
+
+// add records the lease created by a blob writer for the upload session with the given ID.
+func (u *uploadLeases) add(id string, lease leases.Lease) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	u.pruneExpired()
+	u.sessions[id] = append(u.sessions[id], lease)
+}
+
+// remove forgets the given lease of the upload session, e.g. when the lease is deleted by the blob writer.
+func (u *uploadLeases) remove(id string, lease leases.Lease) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	u.sessions[id] = slices.DeleteFunc(u.sessions[id], func(l leases.Lease) bool {
+		return l.ID == lease.ID
+	})
+	if len(u.sessions[id]) == 0 {
+		delete(u.sessions, id)
+	}
+}
+
+// removeSession forgets all the leases of the upload session and returns them so that they can be deleted.
+func (u *uploadLeases) removeSession(id string) []leases.Lease {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	sessionLeases := u.sessions[id]
+	delete(u.sessions, id)
+	return sessionLeases
+}
+
+// commit associates all the leases of the upload session with the digest of the blob committed in the namespace.
+func (u *uploadLeases) commit(namespace, id string, dgst digest.Digest) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	blob := namespacedDigest{namespace: namespace, digest: dgst}
+	u.blobs[blob] = append(u.blobs[blob], u.sessions[id]...)
+	delete(u.sessions, id)
+}
+
+// release forgets the leases that were used to upload the blobs with the given digests in the namespace and returns
+// them so that they can be deleted.
+func (u *uploadLeases) release(namespace string, dgsts []digest.Digest) []leases.Lease {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	var released []leases.Lease
+	for _, dgst := range dgsts {
+		blob := namespacedDigest{namespace: namespace, digest: dgst}
+		released = append(released, u.blobs[blob]...)
+		delete(u.blobs, blob)
+	}
+	return released
+}
+
+// pruneExpired forgets the leases that have already expired. Must be called with the mutex held.
+func (u *uploadLeases) pruneExpired() {
+	expired := func(l leases.Lease) bool {
+		return time.Since(l.CreatedAt) > leaseExpiration
+	}
+	for id, sessionLeases := range u.sessions {
+		if sessionLeases = slices.DeleteFunc(sessionLeases, expired); len(sessionLeases) == 0 {
+			delete(u.sessions, id)
+		} else {
+			u.sessions[id] = sessionLeases
+		}
+	}
+	for blob, blobLeases := range u.blobs {
+		if blobLeases = slices.DeleteFunc(blobLeases, expired); len(blobLeases) == 0 {
+			delete(u.blobs, blob)
+		} else {
+			u.blobs[blob] = blobLeases
+		}
+	}
+}
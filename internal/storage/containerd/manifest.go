@@ -2,22 +2,28 @@ package containerd
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"slices"
 
+	"github.com/containerd/containerd/v2/core/images"
 	"github.com/distribution/distribution/v3"
 	"github.com/distribution/distribution/v3/manifest/manifestlist"
 	"github.com/distribution/distribution/v3/manifest/ocischema"
 	"github.com/distribution/distribution/v3/manifest/schema2"
+	"github.com/distribution/distribution/v3/registry/api/errcode"
 	"github.com/distribution/reference"
 	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/sirupsen/logrus"
 )
 
 // manifestService implements distribution.ManifestService backed by containerd content store.
 type manifestService struct {
-	repo      reference.Named
-	blobStore *blobStore
+	repo       reference.Named
+	blobStore  *blobStore
+	tagService *tagService
 }
 
 // Exists checks if a manifest exists in the blob store by digest.
@@ -33,6 +39,16 @@ func (m *manifestService) Exists(ctx context.Context, dgst digest.Digest) (bool,
 func (m *manifestService) Get(
 	ctx context.Context, dgst digest.Digest, _ ...distribution.ManifestServiceOption,
 ) (distribution.Manifest, error) {
+	desc, err := m.blobStore.Stat(ctx, dgst)
+	if err != nil {
+		if errors.Is(err, distribution.ErrBlobUnknown) {
+			return nil, distribution.ErrManifestUnknownRevision{
+				Name:     m.repo.Name(),
+				Revision: dgst,
+			}
+		}
+		return nil, err
+	}
 	blob, err := m.blobStore.Get(ctx, dgst)
 	if err != nil {
 		if errors.Is(err, distribution.ErrBlobUnknown) {
@@ -44,11 +60,32 @@ func (m *manifestService) Get(
 		return nil, err
 	}
 
-	manifest, err := unmarshalManifest(blob)
+	manifest, err := unmarshalManifest(desc.MediaType, blob)
 	if err != nil {
 		return nil, fmt.Errorf("unmarshal manifest: %w", err)
 	}
 
+	if m.blobStore.regenerator != nil {
+		// Regenerate the layers discarded after unpacking. The manifest can only be served as is if all of them are
+		// identical to the original ones, otherwise the image has to be pulled by tag to get the rewritten manifest.
+		mediaType, _, _ := manifest.Payload()
+		repaired, err := m.blobStore.regenerator.repair(
+			ctx, ocispec.Descriptor{MediaType: mediaType, Digest: dgst, Size: desc.Size},
+		)
+		if err != nil {
+			return nil, fmt.Errorf("repair manifest '%s': %w", dgst, err)
+		}
+		if repaired.Digest != dgst {
+			return nil, errcode.ErrorCodeManifestBlobUnknown.WithDetail(
+				fmt.Sprintf(
+					"manifest '%s' references layers deleted from containerd content store after unpacking "+
+						"(discard_unpacked_layers) that can't be regenerated identically from snapshots; "+
+						"pull the image by tag to get the rewritten manifest '%s'", dgst, repaired.Digest,
+				),
+			)
+		}
+	}
+
 	if mediaType, _, err := manifest.Payload(); err == nil {
 		logrus.WithFields(
 			logrus.Fields{
@@ -71,21 +108,162 @@ func (m *manifestService) Put(
 		return "", fmt.Errorf("get manifest payload: %w", err)
 	}
 
+	if err = m.verifyReferences(ctx, manifest); err != nil {
+		return "", err
+	}
+
 	desc, err := m.blobStore.Put(ctx, mediaType, payload)
 	if err != nil {
 		return "", fmt.Errorf("put manifest in blob store: %w", err)
 	}
 
+	// Blob uploads don't carry a media type so the media types of the referenced blobs are learned from the manifest.
+	for _, ref := range manifest.References() {
+		if ref.MediaType == "" {
+			continue
+		}
+		if err = m.blobStore.setMediaType(ctx, ref.Digest, ref.MediaType); err != nil &&
+			!errors.Is(err, distribution.ErrBlobUnknown) {
+			return "", err
+		}
+	}
+
+	subject, err := indexReferrers(ctx, m.blobStore.client.ContentStore(), desc, payload)
+	if err != nil {
+		return "", fmt.Errorf("index referrers for manifest: %w", err)
+	}
+	// The OCI distribution spec requires the OCI-Subject header to be set in the response if the manifest has
+	// a subject to indicate that the registry supports the referrers API. The header is set by the referrers handler.
+	if subject != nil {
+		setManifestSubject(ctx, subject.Digest)
+	}
+
 	return desc.Digest, nil
 }
 
-// Delete is not supported to keep things simple.
-func (m *manifestService) Delete(_ context.Context, _ digest.Digest) error {
-	return distribution.ErrUnsupported
+// verifyReferences checks that all the content referenced by the manifest, e.g. config and layers of an image manifest
+// or child manifests of an index, exists in the containerd content store and has the declared size. Non-distributable
+// (foreign) layers with URLs are not verified as they aren't expected to be pushed to the registry. Content that only
+// exists in a peer or the upstream registry isn't accepted as the pushed image must be complete in containerd.
+func (m *manifestService) verifyReferences(ctx context.Context, manifest distribution.Manifest) error {
+	var errs distribution.ErrManifestVerification
+	for _, ref := range manifest.References() {
+		if len(ref.URLs) > 0 {
+			continue
+		}
+		if err := ref.Digest.Validate(); err != nil {
+			return errcode.ErrorCodeManifestInvalid.WithDetail(
+				fmt.Sprintf("invalid digest '%s' of referenced content: %v", ref.Digest, err),
+			)
+		}
+
+		desc, err := m.blobStore.statLocal(ctx, ref.Digest)
+		if err != nil {
+			if errors.Is(err, distribution.ErrBlobUnknown) {
+				errs = append(errs, distribution.ErrManifestBlobUnknown{Digest: ref.Digest})
+				continue
+			}
+			return err
+		}
+		if desc.Size != ref.Size {
+			return errcode.ErrorCodeManifestInvalid.WithDetail(
+				fmt.Sprintf(
+					"size %d of referenced content '%s' doesn't match the actual size %d",
+					ref.Size, ref.Digest, desc.Size,
+				),
+			)
+		}
+	}
+
+	if len(errs) > 0 {
+		logrus.WithFields(
+			logrus.Fields{
+				"repo":   m.repo.Name(),
+				"errors": errs.Error(),
+			},
+		).Debug("Manifest references content that doesn't exist in containerd content store.")
+		return errs
+	}
+	return nil
 }
 
-// unmarshalManifest attempts to unmarshal a manifest in various formats.
-func unmarshalManifest(blob []byte) (distribution.Manifest, error) {
+// Delete deletes all images in the repository that point to the manifest with the given digest from the containerd
+// image store. If the manifest exists but isn't referenced by any image in the repository, e.g. it was pushed
+// by digest, its content is left to be deleted by containerd garbage collection.
+// Deleting a child manifest of an image index referenced by an image in the repository is not supported as it would
+// untag the whole multi-platform image. The image index should be deleted instead.
+func (m *manifestService) Delete(ctx context.Context, dgst digest.Digest) error {
+	imgs, err := m.tagService.images(ctx)
+	if err != nil {
+		return err
+	}
+
+	contains := make(map[digest.Digest]bool)
+	for _, img := range imgs {
+		if img.Target.Digest == dgst {
+			continue
+		}
+		found, err := m.tagService.indexContains(ctx, img.Target, dgst, contains)
+		if err != nil {
+			return err
+		}
+		if found {
+			logrus.WithFields(
+				logrus.Fields{
+					"repo":   m.repo.Name(),
+					"digest": dgst,
+					"image":  img.Name,
+				},
+			).Debug("Refusing to delete a manifest that is a child of an image index.")
+			return distribution.ErrUnsupported
+		}
+	}
+
+	imgs = slices.DeleteFunc(imgs, func(img images.Image) bool {
+		return img.Target.Digest != dgst
+	})
+
+	if len(imgs) == 0 {
+		exists, err := m.Exists(ctx, dgst)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return distribution.ErrBlobUnknown
+		}
+		logrus.WithFields(
+			logrus.Fields{
+				"repo":   m.repo.Name(),
+				"digest": dgst,
+			},
+		).Debug("Manifest is not referenced by any image in the repository, nothing to delete.")
+		return nil
+	}
+
+	return m.tagService.deleteImages(ctx, imgs)
+}
+
+// unmarshalManifest unmarshals a manifest with the given media type. If the media type is unknown, e.g. the manifest
+// was pulled by containerd and not pushed through the registry, it's taken from the mediaType field of the manifest.
+// If the manifest doesn't have the mediaType field, various formats are tried.
+func unmarshalManifest(mediaType string, blob []byte) (distribution.Manifest, error) {
+	if mediaType == "" || mediaType == defaultMediaType {
+		var versioned struct {
+			MediaType string `json:"mediaType"`
+		}
+		if err := json.Unmarshal(blob, &versioned); err != nil {
+			return nil, distribution.ErrManifestVerification{err}
+		}
+		mediaType = versioned.MediaType
+	}
+	if mediaType != "" {
+		manifest, _, err := distribution.UnmarshalManifest(mediaType, blob)
+		if err != nil {
+			return nil, distribution.ErrManifestVerification{err}
+		}
+		return manifest, nil
+	}
+
 	// Try OCI manifest.
 	var ociManifest ocischema.DeserializedManifest
 	if err := ociManifest.UnmarshalJSON(blob); err == nil {
@@ -0,0 +1,31 @@
+package containerd
+
+import "github.com/prometheus/client_golang/prometheus"
+
+// metricsNamespace is the prefix of all unregistry metric names.
+const metricsNamespace = "unregistry"
+
+var (
+	siblingBlobsReused = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: "sibling",
+			Name:      "blobs_reused_total",
+			Help:      "Number of blobs reused from a sibling containerd namespace instead of being uploaded.",
+		},
+		[]string{"source", "target"},
+	)
+	siblingBytesSaved = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: "sibling",
+			Name:      "bytes_saved_total",
+			Help:      "Number of bytes clients didn't have to upload as the blobs were reused from a sibling namespace.",
+		},
+		[]string{"source", "target"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(siblingBlobsReused, siblingBytesSaved)
+}
@@ -3,11 +3,16 @@ package containerd
 import (
 	"context"
 	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
 
 	"github.com/containerd/containerd/v2/client"
 	"github.com/distribution/distribution/v3"
 	middleware "github.com/distribution/distribution/v3/registry/middleware/registry"
 	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/sirupsen/logrus"
 )
 
 const MiddlewareName = "containerd"
@@ -22,16 +27,13 @@ func init() {
 	}
 }
 
-// registryMiddleware is the registry middleware factory function that creates an instance of registry.
-func registryMiddleware(
-	_ context.Context, _ distribution.Namespace, _ storagedriver.StorageDriver, options map[string]interface{},
-) (distribution.Namespace, error) {
-	sock, ok := options["sock"].(string)
-	if !ok || sock == "" {
+// NewClient creates a containerd client connected to the given socket that uses the given namespace by default.
+// The client should be passed to the registry middleware in the "client" option.
+func NewClient(sock, namespace string) (*client.Client, error) {
+	if sock == "" {
 		return nil, fmt.Errorf("containerd socket path is required")
 	}
-	namespace, ok := options["namespace"].(string)
-	if !ok || namespace == "" {
+	if namespace == "" {
 		return nil, fmt.Errorf("containerd namespace is required")
 	}
 
@@ -39,6 +41,154 @@ func registryMiddleware(
 	if err != nil {
 		return nil, fmt.Errorf("create containerd client: %w", err)
 	}
+	return cli, nil
+}
+
+// registryMiddleware is the registry middleware factory function that creates an instance of registry.
+func registryMiddleware(
+	ctx context.Context, _ distribution.Namespace, _ storagedriver.StorageDriver, options map[string]interface{},
+) (distribution.Namespace, error) {
+	cli, ok := options["client"].(*client.Client)
+	if !ok || cli == nil {
+		return nil, fmt.Errorf("containerd client is required")
+	}
+
+	// gcondelete is optional and disabled by default.
+	gcOnDelete, _ := options["gcondelete"].(bool)
+	// staleuploadage is optional. Reaping of stale uploads is disabled if not set.
+	staleUploadAge, _ := options["staleuploadage"].(time.Duration)
+	// The leases of uploaded blobs are only deleted once an image referencing them is tagged so a shorter age would
+	// delete the leases of a slow push in progress and its uploaded blobs would be garbage collected.
+	if staleUploadAge > 0 && staleUploadAge < leaseExpiration {
+		return nil, fmt.Errorf("stale upload age %s must be at least %s or 0 to disable", staleUploadAge, leaseExpiration)
+	}
+
+	// contentroot is optional. Blobs are served through the containerd API if not set.
+	contentRoot, _ := options["contentroot"].(string)
+	if contentRoot != "" {
+		if _, err := os.Stat(filepath.Join(contentRoot, "blobs")); err != nil {
+			logrus.WithField("root", contentRoot).WithError(err).Warn(
+				"Containerd content store is not accessible on the local disk, " +
+					"blobs will be served through the containerd API.",
+			)
+		}
+	}
+
+	// unpack is optional and disabled by default. snapshotter, unpackplatforms and unpackpipeline are only used
+	// if it's enabled.
+	var unpacker *unpacker
+	var unpackPipeline *unpackPipeline
+	if unpack, _ := options["unpack"].(bool); unpack {
+		snapshotter, _ := options["snapshotter"].(string)
+		unpackPlatforms, _ := options["unpackplatforms"].([]string)
+		var err error
+		if unpacker, err = newUnpacker(cli, snapshotter, unpackPlatforms); err != nil {
+			return nil, err
+		}
+		if pipeline, _ := options["unpackpipeline"].(bool); pipeline {
+			// The context is canceled when the registry app is shut down.
+			unpackPipeline = newUnpackPipeline(ctx, cli, snapshotter, unpacker.platforms)
+			unpacker.pipeline = unpackPipeline
+		}
+	}
+
+	// dockerload is optional and disabled by default. dockersock and dockerloaddelete are only used if it's enabled.
+	var dockerLoader *dockerLoader
+	if dockerLoad, _ := options["dockerload"].(bool); dockerLoad {
+		dockerSock, _ := options["dockersock"].(string)
+		deleteImage, _ := options["dockerloaddelete"].(bool)
+		var err error
+		if dockerLoader, err = newDockerLoader(dockerSock, deleteImage); err != nil {
+			return nil, err
+		}
+	}
+
+	// dockerfallback is optional and disabled by default. It uses the same dockersock as dockerload.
+	var dockerSource *dockerSource
+	if dockerFallback, _ := options["dockerfallback"].(bool); dockerFallback {
+		dockerSock, _ := options["dockersock"].(string)
+		var err error
+		if dockerSource, err = newDockerSource(cli, dockerSock); err != nil {
+			return nil, err
+		}
+	}
+
+	// regeneratelayers is optional and disabled by default. It uses the same snapshotter as unpack.
+	var regenerator *layerRegenerator
+	if regenerate, _ := options["regeneratelayers"].(bool); regenerate {
+		snapshotter, _ := options["snapshotter"].(string)
+		var err error
+		if regenerator, err = newLayerRegenerator(cli, snapshotter); err != nil {
+			return nil, err
+		}
+	}
+
+	// siblingnamespaces is optional. Blobs missing in the request namespace are not reused from other namespaces
+	// if not set.
+	siblingNamespaces, _ := options["siblingnamespaces"].([]string)
+
+	// peers and peersrv are optional. Images and blobs missing in containerd are not looked up in peers if not set.
+	var peerSet *peers
+	peerURLs, _ := options["peers"].([]string)
+	peerSRV, _ := options["peersrv"].(string)
+	if len(peerURLs) > 0 || peerSRV != "" {
+		username, _ := options["peerusername"].(string)
+		password, _ := options["peerpassword"].(string)
+		var err error
+		if peerSet, err = newPeers(cli, peerURLs, peerSRV, username, password); err != nil {
+			return nil, err
+		}
+	}
+
+	// namemappings is optional. Repository names are used as is if not set.
+	rules, _ := options["namemappings"].([]string)
+	nameMappings, err := parseNameMappings(rules)
+	if err != nil {
+		return nil, err
+	}
+
+	// replicator is optional. It's created by the caller as it's shared with the replication status endpoint.
+	// Tagged images are not replicated if not set.
+	replicator, _ := options["replicator"].(*Replicator)
+
+	// upstream is optional. Images and blobs missing in containerd are not pulled through if not set.
+	var upstreamRegistry *upstream
+	if upstreamURL, _ := options["upstream"].(string); upstreamURL != "" {
+		username, _ := options["upstreamusername"].(string)
+		password, _ := options["upstreampassword"].(string)
+		var err error
+		if upstreamRegistry, err = newUpstream(cli, upstreamURL, username, password, nil); err != nil {
+			return nil, err
+		}
+	}
+
+	if staleUploadAge > 0 {
+		// namespaces is optional and lists the namespaces selected per request in addition to the default one.
+		additional, _ := options["namespaces"].([]string)
+		reapNamespaces := []string{cli.DefaultNamespace()}
+		for _, ns := range additional {
+			if !slices.Contains(reapNamespaces, ns) {
+				reapNamespaces = append(reapNamespaces, ns)
+			}
+		}
+		// The context is canceled when the registry app is shut down.
+		go newReaper(cli, staleUploadAge, reapNamespaces).run(ctx)
+	}
 
-	return &registry{client: cli}, nil
+	return &registry{
+		client:            cli,
+		gcOnDelete:        gcOnDelete,
+		uploadLeases:      newUploadLeases(),
+		contentRoot:       contentRoot,
+		unpacker:          unpacker,
+		unpackPipeline:    unpackPipeline,
+		dockerLoader:      dockerLoader,
+		dockerSource:      dockerSource,
+		regenerator:       regenerator,
+		siblingNamespaces: siblingNamespaces,
+		peers:             peerSet,
+		upstream:          upstreamRegistry,
+		replicator:        replicator,
+		nameMappings:      nameMappings,
+	}, nil
 }
@@ -0,0 +1,43 @@
+package containerd
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"regexp"
+
+	"github.com/distribution/distribution/v3/registry/api/errcode"
+	"github.com/distribution/reference"
+)
+
+// mirrorNamespaceParam is the query parameter containerd adds to requests to a registry mirror configured in
+// hosts.toml. The value is the host of the registry the image is pulled from, e.g. "?ns=docker.io".
+const mirrorNamespaceParam = "ns"
+
+// mirrorHostRegexp matches a valid registry host in the mirror namespace query parameter.
+var mirrorHostRegexp = regexp.MustCompile(`^` + reference.DomainRegexp.String() + `$`)
+
+// mirrorHostKey is the context key for the registry host the request is mirroring.
+type mirrorHostKey struct{}
+
+// NewMirrorHandler returns an http.Handler that makes unregistry compatible with containerd registry mirror
+// configuration. containerd sends requests for images from any registry to the mirror with the name of the repository
+// in that registry, e.g. "/v2/org/app/manifests/latest?ns=ghcr.io". The handler records the registry host from the
+// "ns" query parameter so that the repository resolves to the containerd image name in that registry, e.g.
+// "ghcr.io/org/app:latest", rather than in docker.io.
+func NewMirrorHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.URL.Query().Get(mirrorNamespaceParam)
+		if host == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if !mirrorHostRegexp.MatchString(host) {
+			_ = errcode.ServeJSON(w, errcode.ErrorCodeNameInvalid.WithDetail(
+				fmt.Sprintf("invalid registry host '%s' in '%s' query parameter", host, mirrorNamespaceParam),
+			))
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), mirrorHostKey{}, host)))
+	})
+}
@@ -0,0 +1,78 @@
+package containerd
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/distribution/reference"
+)
+
+func TestMirrorHandler(t *testing.T) {
+	tests := []struct {
+		name       string
+		url        string
+		repo       string
+		wantStatus int
+		wantRepo   string
+	}{
+		{
+			name:       "no mirror",
+			url:        "/v2/ubuntu/manifests/latest",
+			repo:       "ubuntu",
+			wantStatus: http.StatusOK,
+			wantRepo:   "docker.io/library/ubuntu",
+		},
+		{
+			name:       "docker hub",
+			url:        "/v2/library/nginx/manifests/latest?ns=docker.io",
+			repo:       "library/nginx",
+			wantStatus: http.StatusOK,
+			wantRepo:   "docker.io/library/nginx",
+		},
+		{
+			name:       "ghcr",
+			url:        "/v2/org/app/manifests/latest?ns=ghcr.io",
+			repo:       "org/app",
+			wantStatus: http.StatusOK,
+			wantRepo:   "ghcr.io/org/app",
+		},
+		{
+			name:       "host with port",
+			url:        "/v2/x/y/manifests/latest?ns=registry.example.com:5000",
+			repo:       "x/y",
+			wantStatus: http.StatusOK,
+			wantRepo:   "registry.example.com:5000/x/y",
+		},
+		{
+			name:       "invalid host",
+			url:        "/v2/x/y/manifests/latest?ns=invalid/host",
+			wantStatus: http.StatusBadRequest,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var gotCtx context.Context
+			handler := NewMirrorHandler(http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+				gotCtx = r.Context()
+			}))
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, tt.url, nil))
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("expected status %d, got %d", tt.wantStatus, rec.Code)
+			}
+			if tt.wantRepo == "" {
+				return
+			}
+			name, err := reference.WithName(tt.repo)
+			if err != nil {
+				t.Fatalf("parse repository name: %v", err)
+			}
+			if repo := canonicalRepository(gotCtx, name, nil); repo.Name() != tt.wantRepo {
+				t.Errorf("expected repository %q, got %q", tt.wantRepo, repo.Name())
+			}
+		})
+	}
+}
@@ -0,0 +1,192 @@
+package containerd
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+
+	"github.com/containerd/containerd/v2/client"
+	"github.com/containerd/containerd/v2/pkg/identifiers"
+	"github.com/containerd/containerd/v2/pkg/namespaces"
+	"github.com/distribution/distribution/v3/registry/api/errcode"
+	"github.com/opencontainers/go-digest"
+	"github.com/sirupsen/logrus"
+)
+
+// NamespaceHeader is the request header that selects the containerd namespace for the request.
+const NamespaceHeader = "Unregistry-Namespace"
+
+// namespacedDigest identifies content in a containerd namespace. The same digest may refer to different content
+// records with their own labels and leases in different namespaces.
+type namespacedDigest struct {
+	namespace string
+	digest    digest.Digest
+}
+
+// requestNamespace returns the containerd namespace selected for the request by the namespace handler or
+// the default namespace of the client if none is selected.
+func requestNamespace(ctx context.Context, client *client.Client) string {
+	if ns, ok := namespaces.Namespace(ctx); ok {
+		return ns
+	}
+	return client.DefaultNamespace()
+}
+
+// namespaceHandler selects the containerd namespace for each request and passes the request to the next handler
+// with the namespace set in the request context so that it's used for all containerd API calls made for it.
+type namespaceHandler struct {
+	defaultNamespace string
+	// namespaces are the allowed namespaces including the default one.
+	namespaces []string
+	// hosts maps host names to namespaces.
+	hosts map[string]string
+	next  http.Handler
+}
+
+// NewNamespaceHandler returns an http.Handler that selects the containerd namespace for each request from
+// the allowed namespaces and passes the request to next. The namespace is selected, in order of precedence, by:
+//   - the Unregistry-Namespace header,
+//   - the first component of the repository name if it's one of the additional namespaces, e.g. pushing
+//     "localhost:5000/k8s.io/myapp" stores the "myapp" image in the "k8s.io" namespace,
+//   - the host name of the request mapped to a namespace in hosts.
+//
+// Requests that select a namespace that is not allowed are rejected. Other requests use the default namespace.
+func NewNamespaceHandler(
+	defaultNamespace string, additional []string, hosts map[string]string, next http.Handler,
+) (http.Handler, error) {
+	allowed := []string{defaultNamespace}
+	for _, ns := range additional {
+		if err := identifiers.Validate(ns); err != nil {
+			return nil, fmt.Errorf("invalid containerd namespace '%s': %w", ns, err)
+		}
+		if !slices.Contains(allowed, ns) {
+			allowed = append(allowed, ns)
+		}
+	}
+	hostNamespaces := make(map[string]string, len(hosts))
+	for host, ns := range hosts {
+		if !slices.Contains(allowed, ns) {
+			return nil, fmt.Errorf("containerd namespace '%s' for host '%s' is not allowed", ns, host)
+		}
+		hostNamespaces[strings.ToLower(host)] = ns
+	}
+
+	return &namespaceHandler{
+		defaultNamespace: defaultNamespace,
+		namespaces:       allowed,
+		hosts:            hostNamespaces,
+		next:             next,
+	}, nil
+}
+
+func (h *namespaceHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ns, prefix := h.selectNamespace(r)
+	if !slices.Contains(h.namespaces, ns) {
+		logrus.WithFields(
+			logrus.Fields{
+				"namespace": ns,
+				"remote":    r.RemoteAddr,
+			},
+		).Debug("Rejected request for containerd namespace that is not allowed.")
+		_ = errcode.ServeJSON(w, errcode.ErrorCodeDenied.WithDetail(
+			fmt.Sprintf("containerd namespace '%s' is not allowed", ns),
+		))
+		return
+	}
+
+	r = r.WithContext(namespaces.WithNamespace(r.Context(), ns))
+	if prefix {
+		// Strip the namespace from the repository name and add it back to the URLs the registry returns in
+		// the Location header so that the following requests of the client select the same namespace.
+		r.URL.Path = "/v2/" + strings.TrimPrefix(r.URL.Path, "/v2/"+ns+"/")
+		r.URL.RawPath = ""
+		w = &namespaceResponseWriter{ResponseWriter: w, namespace: ns}
+	}
+	h.next.ServeHTTP(w, r)
+}
+
+// selectNamespace returns the namespace selected for the request and whether it's selected by the repository name
+// prefix.
+func (h *namespaceHandler) selectNamespace(r *http.Request) (string, bool) {
+	if ns := r.Header.Get(NamespaceHeader); ns != "" {
+		return ns, false
+	}
+
+	if rest, ok := strings.CutPrefix(r.URL.Path, "/v2/"); ok {
+		if ns, name, ok := strings.Cut(rest, "/"); ok && name != "" && ns != h.defaultNamespace &&
+			slices.Contains(h.namespaces, ns) {
+			return ns, true
+		}
+	}
+
+	host := r.Host
+	if hostname, _, err := net.SplitHostPort(host); err == nil {
+		host = hostname
+	}
+	if ns, ok := h.hosts[strings.ToLower(host)]; ok {
+		return ns, false
+	}
+
+	return h.defaultNamespace, false
+}
+
+// namespaceResponseWriter adds the namespace prefix to the repository name in the Location header of responses.
+type namespaceResponseWriter struct {
+	http.ResponseWriter
+	namespace   string
+	wroteHeader bool
+}
+
+func (w *namespaceResponseWriter) WriteHeader(code int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		if location := w.Header().Get("Location"); location != "" {
+			w.Header().Set("Location", addNamespacePrefix(location, w.namespace))
+		}
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *namespaceResponseWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// ReadFrom keeps the io.ReaderFrom implementation of the original response writer available for sendfile.
+func (w *namespaceResponseWriter) ReadFrom(r io.Reader) (int64, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if rf, ok := w.ResponseWriter.(io.ReaderFrom); ok {
+		return rf.ReadFrom(r)
+	}
+	return io.Copy(w.ResponseWriter, r)
+}
+
+func (w *namespaceResponseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// addNamespacePrefix adds the namespace as the first component of the repository name in the registry API URL.
+func addNamespacePrefix(location, namespace string) string {
+	u, err := url.Parse(location)
+	if err != nil {
+		return location
+	}
+	rest, ok := strings.CutPrefix(u.Path, "/v2/")
+	if !ok {
+		return location
+	}
+	u.Path = "/v2/" + namespace + "/" + rest
+	u.RawPath = ""
+	return u.String()
+}
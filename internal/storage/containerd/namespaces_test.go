@@ -0,0 +1,121 @@
+package containerd
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/containerd/containerd/v2/pkg/namespaces"
+)
+
+func TestNamespaceHandler(t *testing.T) {
+	var gotNamespace, gotPath string
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotNamespace, _ = namespaces.Namespace(r.Context())
+		gotPath = r.URL.Path
+		w.Header().Set("Location", "http://"+r.Host+"/v2/myapp/blobs/uploads/123")
+		w.WriteHeader(http.StatusAccepted)
+	})
+	handler, err := NewNamespaceHandler(
+		"moby", []string{"k8s.io"}, map[string]string{"K3s.example.com": "k8s.io"}, next,
+	)
+	if err != nil {
+		t.Fatalf("create namespace handler: %v", err)
+	}
+
+	tests := []struct {
+		name         string
+		host         string
+		path         string
+		header       string
+		wantStatus   int
+		wantNS       string
+		wantPath     string
+		wantLocation string
+	}{
+		{
+			name:         "default",
+			host:         "localhost:5000",
+			path:         "/v2/myapp/blobs/uploads/",
+			wantStatus:   http.StatusAccepted,
+			wantNS:       "moby",
+			wantPath:     "/v2/myapp/blobs/uploads/",
+			wantLocation: "http://localhost:5000/v2/myapp/blobs/uploads/123",
+		},
+		{
+			name:         "path prefix",
+			host:         "localhost:5000",
+			path:         "/v2/k8s.io/myapp/blobs/uploads/",
+			wantStatus:   http.StatusAccepted,
+			wantNS:       "k8s.io",
+			wantPath:     "/v2/myapp/blobs/uploads/",
+			wantLocation: "http://localhost:5000/v2/k8s.io/myapp/blobs/uploads/123",
+		},
+		{
+			name:         "default namespace prefix is a repository name",
+			host:         "localhost:5000",
+			path:         "/v2/moby/buildkit/manifests/latest",
+			wantStatus:   http.StatusAccepted,
+			wantNS:       "moby",
+			wantPath:     "/v2/moby/buildkit/manifests/latest",
+			wantLocation: "http://localhost:5000/v2/myapp/blobs/uploads/123",
+		},
+		{
+			name:         "host",
+			host:         "k3s.example.com:5000",
+			path:         "/v2/myapp/blobs/uploads/",
+			wantStatus:   http.StatusAccepted,
+			wantNS:       "k8s.io",
+			wantPath:     "/v2/myapp/blobs/uploads/",
+			wantLocation: "http://k3s.example.com:5000/v2/myapp/blobs/uploads/123",
+		},
+		{
+			name:         "header",
+			host:         "k3s.example.com:5000",
+			path:         "/v2/myapp/blobs/uploads/",
+			header:       "moby",
+			wantStatus:   http.StatusAccepted,
+			wantNS:       "moby",
+			wantPath:     "/v2/myapp/blobs/uploads/",
+			wantLocation: "http://k3s.example.com:5000/v2/myapp/blobs/uploads/123",
+		},
+		{
+			name:       "header not allowed",
+			host:       "localhost:5000",
+			path:       "/v2/myapp/blobs/uploads/",
+			header:     "default",
+			wantStatus: http.StatusForbidden,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gotNamespace, gotPath = "", ""
+			req := httptest.NewRequest(http.MethodPost, "http://"+tt.host+tt.path, nil)
+			if tt.header != "" {
+				req.Header.Set(NamespaceHeader, tt.header)
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("expected status %d, got %d", tt.wantStatus, rec.Code)
+			}
+			if gotNamespace != tt.wantNS {
+				t.Errorf("expected namespace %q, got %q", tt.wantNS, gotNamespace)
+			}
+			if gotPath != tt.wantPath {
+				t.Errorf("expected path %q, got %q", tt.wantPath, gotPath)
+			}
+			if location := rec.Header().Get("Location"); location != tt.wantLocation {
+				t.Errorf("expected location %q, got %q", tt.wantLocation, location)
+			}
+		})
+	}
+}
+
+func TestNewNamespaceHandlerHostNotAllowed(t *testing.T) {
+	_, err := NewNamespaceHandler("moby", nil, map[string]string{"k3s.example.com": "k8s.io"}, http.NotFoundHandler())
+	if err == nil {
+		t.Fatal("expected error for host mapped to namespace that is not allowed")
+	}
+}
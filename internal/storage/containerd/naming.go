@@ -0,0 +1,113 @@
+package containerd
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/distribution/distribution/v3/registry/api/errcode"
+	"github.com/distribution/reference"
+	"github.com/sirupsen/logrus"
+)
+
+// RepositoryHeader is the HTTP header a client can set to store the pushed image under the given repository name in
+// the containerd image store instead of the repository name in the request path, e.g. "localhost:5000/myapp" when
+// pushing to "/v2/localhost-5000/myapp/manifests/latest".
+const RepositoryHeader = "Unregistry-Repository"
+
+// NameMappingHeader is the HTTP response header that advertises the support for the name mapping rules and
+// the RepositoryHeader so that clients, e.g. docker-pussh, can tell from any response whether a pushed image is stored
+// under the mapped name without inspecting the image store.
+const NameMappingHeader = "Unregistry-Name-Mapping"
+
+// repositoryKey is the context key for the repository name set by the client in the RepositoryHeader.
+type repositoryKey struct{}
+
+// NewRepositoryHandler returns an http.Handler that records the repository name from the RepositoryHeader so that
+// the tags of the repository in the request path resolve to the containerd images with that name. It also sets
+// the NameMappingHeader on all responses.
+func NewRepositoryHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(NameMappingHeader, "supported")
+		name := r.Header.Get(RepositoryHeader)
+		if name == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		ref, err := reference.ParseNormalizedNamed(name)
+		if err != nil || !reference.IsNameOnly(ref) {
+			_ = errcode.ServeJSON(w, errcode.ErrorCodeNameInvalid.WithDetail(
+				fmt.Sprintf("invalid repository name '%s' in '%s' header", name, RepositoryHeader),
+			))
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), repositoryKey{}, ref)))
+	})
+}
+
+// nameMapping is a rule that rewrites the repository names matching the pattern to the containerd image names.
+type nameMapping struct {
+	pattern     *regexp.Regexp
+	replacement string
+}
+
+// parseNameMappings parses the name mapping rules in the "REGEX=REPLACEMENT" format, e.g.
+// `^localhost-([0-9]+)/(.+)$=localhost:$1/$2`. The regular expression is matched against the full repository name
+// in the request path and the replacement can reference its capture groups. The first matching rule applies.
+func parseNameMappings(rules []string) ([]nameMapping, error) {
+	mappings := make([]nameMapping, 0, len(rules))
+	for _, rule := range rules {
+		i := strings.LastIndex(rule, "=")
+		if i <= 0 {
+			return nil, fmt.Errorf("invalid name mapping '%s': expected REGEX=REPLACEMENT", rule)
+		}
+		pattern, err := regexp.Compile(rule[:i])
+		if err != nil {
+			return nil, fmt.Errorf("invalid name mapping '%s': %w", rule, err)
+		}
+		mappings = append(mappings, nameMapping{pattern: pattern, replacement: rule[i+1:]})
+	}
+	return mappings, nil
+}
+
+// mapName returns the repository name rewritten by the first matching rule or the name as is if none match.
+func mapName(mappings []nameMapping, name string) string {
+	for _, m := range mappings {
+		if m.pattern.MatchString(name) {
+			return m.pattern.ReplaceAllString(name, m.replacement)
+		}
+	}
+	return name
+}
+
+// canonicalRepository returns the repository reference in a normalized form, the way containerd image store expects
+// it. The repository name set by the client in the RepositoryHeader takes precedence. Otherwise, the name in
+// the request path is rewritten by the first matching name mapping rule and resolved in the registry the request is
+// mirroring if any, docker.io otherwise. For example, "org/app" is "ghcr.io/org/app" when mirroring ghcr.io, and
+// "ubuntu" is "docker.io/library/ubuntu".
+func canonicalRepository(ctx context.Context, name reference.Named, mappings []nameMapping) reference.Named {
+	if ref, ok := ctx.Value(repositoryKey{}).(reference.Named); ok {
+		return ref
+	}
+
+	mapped := mapName(mappings, name.Name())
+	if host, ok := ctx.Value(mirrorHostKey{}).(string); ok {
+		mapped = host + "/" + mapped
+	}
+	ref, err := reference.ParseNormalizedNamed(mapped)
+	if err == nil && reference.IsNameOnly(ref) {
+		return ref
+	}
+	logrus.WithFields(
+		logrus.Fields{
+			"repo":   name.Name(),
+			"mapped": mapped,
+		},
+	).WithError(err).Warn("Invalid repository name after mapping, using the name as is.")
+
+	// Shouldn't return an error as name is a valid reference.
+	ref, _ = reference.ParseNormalizedNamed(name.String())
+	return ref
+}
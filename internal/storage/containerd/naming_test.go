@@ -0,0 +1,87 @@
+package containerd
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/distribution/reference"
+)
+
+func TestCanonicalRepository(t *testing.T) {
+	mappings, err := parseNameMappings([]string{
+		// The rule docker pussh uses to store images pushed with a registry port under their original names.
+		`^([^/_]*[.][^/_]*|localhost)__([0-9]+)/(.+)$=$1:$2/$3`,
+		`^registry\.example\.com/(.+)$=$1`,
+		`^invalid/(.+)$=$1:latest`,
+	})
+	if err != nil {
+		t.Fatalf("parse name mappings: %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		repo   string
+		header string
+		want   string
+	}{
+		{name: "no mapping", repo: "myapp", want: "docker.io/library/myapp"},
+		{name: "registry port", repo: "localhost__5000/myapp", want: "localhost:5000/myapp"},
+		{name: "registry domain port", repo: "registry.example.com__5000/org/app", want: "registry.example.com:5000/org/app"},
+		{name: "name with number suffix", repo: "my-app-2/foo", want: "docker.io/my-app-2/foo"},
+		{name: "registry with number suffix", repo: "my.reg-2/app", want: "my.reg-2/app"},
+		{name: "strip registry host", repo: "registry.example.com/org/app", want: "docker.io/org/app"},
+		{name: "invalid mapped name", repo: "invalid/app", want: "docker.io/invalid/app"},
+		{name: "header", repo: "localhost__5000/myapp", header: "ghcr.io/org/app", want: "ghcr.io/org/app"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			handler := NewRepositoryHandler(http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+				ctx = r.Context()
+			}))
+			req := httptest.NewRequest(http.MethodGet, "/v2/"+tt.repo+"/manifests/latest", nil)
+			if tt.header != "" {
+				req.Header.Set(RepositoryHeader, tt.header)
+			}
+			handler.ServeHTTP(httptest.NewRecorder(), req)
+
+			name, err := reference.WithName(tt.repo)
+			if err != nil {
+				t.Fatalf("parse repository name: %v", err)
+			}
+			if repo := canonicalRepository(ctx, name, mappings); repo.Name() != tt.want {
+				t.Errorf("expected repository %q, got %q", tt.want, repo.Name())
+			}
+		})
+	}
+}
+
+func TestRepositoryHandlerInvalidHeader(t *testing.T) {
+	handler := NewRepositoryHandler(http.NotFoundHandler())
+	req := httptest.NewRequest(http.MethodGet, "/v2/myapp/manifests/latest", nil)
+	req.Header.Set(RepositoryHeader, "myapp:latest")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("expected status %d, got %d", http.StatusBadRequest, rec.Code)
+	}
+}
+
+func TestRepositoryHandlerNameMappingHeader(t *testing.T) {
+	handler := NewRepositoryHandler(http.NotFoundHandler())
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/v2/", nil))
+	if got := rec.Header().Get(NameMappingHeader); got != "supported" {
+		t.Errorf("expected %s header %q, got %q", NameMappingHeader, "supported", got)
+	}
+}
+
+func TestParseNameMappingsInvalid(t *testing.T) {
+	for _, rule := range []string{"no-replacement", "=replacement", "(unclosed=$1"} {
+		if _, err := parseNameMappings([]string{rule}); err == nil {
+			t.Errorf("expected error for name mapping %q", rule)
+		}
+	}
+}
@@ -0,0 +1,253 @@
+package containerd
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/containerd/containerd/v2/client"
+	"github.com/containerd/errdefs"
+	"github.com/distribution/reference"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// PeerHeader is the HTTP header set on requests from unregistry peers looking up content they miss. Such requests
+	// are served only from the local containerd so that peers don't forward lookups to each other in a loop.
+	PeerHeader = "Unregistry-Peer"
+	// peerLookupTimeout is the maximum time to wait for peers to report whether they have the content.
+	peerLookupTimeout = 5 * time.Second
+	// peerLookupConcurrency is the maximum number of peers queried at the same time for the content.
+	peerLookupConcurrency = 4
+	// peerMissTTL is the time for which content that none of the peers have isn't looked up again.
+	peerMissTTL = 10 * time.Second
+	// peerDiscoveryTTL is the time for which the peers discovered via the DNS SRV record are cached.
+	peerDiscoveryTTL = 30 * time.Second
+)
+
+// peerRequestKey is the context key for marking requests from unregistry peers.
+type peerRequestKey struct{}
+
+// NewPeerHandler returns an http.Handler that marks requests with the PeerHeader as requests from unregistry peers.
+func NewPeerHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get(PeerHeader) != "" {
+			r = r.WithContext(context.WithValue(r.Context(), peerRequestKey{}, true))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// isPeerRequest checks if the request is sent by an unregistry peer and must only be served from the local containerd.
+func isPeerRequest(ctx context.Context) bool {
+	peer, _ := ctx.Value(peerRequestKey{}).(bool)
+	return peer
+}
+
+// peers looks up images and blobs missing in containerd on other unregistry instances, e.g. on other nodes of
+// a cluster, so that they can be fetched from the peer that has them instead of failing the request. The peers are
+// configured statically and/or discovered via a DNS SRV record. Lookups query the peers concurrently and use the first
+// peer that has the content. Content that none of the peers have is remembered for peerMissTTL to avoid querying them
+// again on every retry of the client.
+type peers struct {
+	client *client.Client
+	// urls are the URLs of the statically configured peers, e.g. "http://node2:5000".
+	urls []string
+	// srv is the optional DNS SRV record name to discover the peers, e.g. "_unregistry._tcp.example.com".
+	srv string
+	// username and password are the optional credentials to authenticate to the peers that require authentication.
+	username string
+	password string
+	log      *logrus.Entry
+
+	mu           sync.Mutex
+	discovered   []string
+	discoveredAt time.Time
+	// misses maps the content keys in their namespaces that none of the peers have to the lookup time.
+	misses map[string]time.Time
+}
+
+// newPeers creates peers with the statically configured peer URLs and/or the DNS SRV record name to discover them.
+// The credentials are optional.
+func newPeers(client *client.Client, urls []string, srv, username, password string) (*peers, error) {
+	for _, peerURL := range urls {
+		if _, err := newUpstream(client, peerURL, "", "", nil); err != nil {
+			return nil, fmt.Errorf("invalid peer: %w", err)
+		}
+	}
+
+	return &peers{
+		client:   client,
+		urls:     urls,
+		srv:      srv,
+		username: username,
+		password: password,
+		log:      logrus.WithField("component", "peers"),
+		misses:   make(map[string]time.Time),
+	}, nil
+}
+
+// peerURLs returns the URLs of the statically configured and discovered peers. The discovered peers are cached for
+// peerDiscoveryTTL. If the discovery fails, the previously discovered peers are used.
+func (p *peers) peerURLs(ctx context.Context) []string {
+	if p.srv == "" {
+		return p.urls
+	}
+
+	p.mu.Lock()
+	stale := time.Since(p.discoveredAt) > peerDiscoveryTTL
+	if stale {
+		// The concurrent lookups use the previously discovered peers while the record is being resolved. The failed
+		// discovery isn't retried on every lookup either.
+		p.discoveredAt = time.Now()
+	}
+	p.mu.Unlock()
+
+	// Resolve the record without holding the lock so that a slow DNS server doesn't block the other lookups.
+	var discovered []string
+	if stale {
+		_, records, err := net.DefaultResolver.LookupSRV(ctx, "", "", p.srv)
+		if err != nil {
+			p.log.WithField("srv", p.srv).WithError(err).Warn("Failed to discover peers via DNS SRV record.")
+		} else {
+			discovered = make([]string, 0, len(records))
+			for _, record := range records {
+				host := strings.TrimSuffix(record.Target, ".")
+				discovered = append(discovered, "http://"+net.JoinHostPort(host, strconv.Itoa(int(record.Port))))
+			}
+		}
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if discovered != nil {
+		p.discovered = discovered
+	}
+	urls := append([]string{}, p.urls...)
+	for _, peerURL := range p.discovered {
+		if !slices.Contains(urls, peerURL) {
+			urls = append(urls, peerURL)
+		}
+	}
+	return urls
+}
+
+// missed checks if none of the peers had the content with the key in the namespace recently.
+func (p *peers) missed(key string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for k, missedAt := range p.misses {
+		if time.Since(missedAt) > peerMissTTL {
+			delete(p.misses, k)
+		}
+	}
+	_, ok := p.misses[key]
+	return ok
+}
+
+// miss remembers that none of the peers have the content with the key in the namespace.
+func (p *peers) miss(key string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.misses[key] = time.Now()
+}
+
+// find queries the peers concurrently with the lookup function and returns the first peer that has the content with
+// the key in the request namespace. It returns errdefs.ErrNotFound if none of the peers have it.
+func (p *peers) find(
+	ctx context.Context, key string, lookup func(context.Context, *upstream) (ocispec.Descriptor, error),
+) (*upstream, ocispec.Descriptor, error) {
+	namespace := requestNamespace(ctx, p.client)
+	missKey := namespace + "/" + key
+	if p.missed(missKey) {
+		return nil, ocispec.Descriptor{}, fmt.Errorf("'%s' in peers: %w", key, errdefs.ErrNotFound)
+	}
+
+	type result struct {
+		peer *upstream
+		desc ocispec.Descriptor
+	}
+	urls := p.peerURLs(ctx)
+	// Buffered so that the lookups don't block once a peer is found.
+	results := make(chan *result, len(urls))
+	sem := make(chan struct{}, peerLookupConcurrency)
+	lookupCtx, cancel := context.WithTimeout(ctx, peerLookupTimeout)
+	defer cancel()
+
+	// Ask the peer to look up the content in the same namespace and only in its local containerd.
+	headers := http.Header{
+		PeerHeader:      []string{"true"},
+		NamespaceHeader: []string{namespace},
+	}
+	for _, peerURL := range urls {
+		go func() {
+			select {
+			case sem <- struct{}{}:
+				defer func() { <-sem }()
+			case <-lookupCtx.Done():
+				results <- nil
+				return
+			}
+
+			peer, err := newUpstream(p.client, peerURL, p.username, p.password, headers)
+			if err != nil {
+				results <- nil
+				return
+			}
+			peer.log = p.log.WithField("peer", peer.host)
+			desc, err := lookup(lookupCtx, peer)
+			if err != nil {
+				if !errdefs.IsNotFound(err) && lookupCtx.Err() == nil {
+					peer.log.WithError(err).Debug("Failed to look up content in peer.")
+				}
+				results <- nil
+				return
+			}
+			results <- &result{peer: peer, desc: desc}
+		}()
+	}
+
+	for range urls {
+		if r := <-results; r != nil {
+			r.peer.log.WithFields(
+				logrus.Fields{
+					"key":       key,
+					"namespace": namespace,
+				},
+			).Debug("Found content missing in containerd in peer.")
+			return r.peer, r.desc, nil
+		}
+	}
+	p.miss(missKey)
+
+	return nil, ocispec.Descriptor{}, fmt.Errorf("'%s' in peers: %w", key, errdefs.ErrNotFound)
+}
+
+// findBlob returns the first peer that has the blob and its descriptor.
+func (p *peers) findBlob(
+	ctx context.Context, repo reference.Named, dgst digest.Digest,
+) (*upstream, ocispec.Descriptor, error) {
+	return p.find(ctx, dgst.String(), func(ctx context.Context, peer *upstream) (ocispec.Descriptor, error) {
+		return peer.stat(ctx, repo, dgst)
+	})
+}
+
+// findTag returns the first peer that has the image with the tag.
+func (p *peers) findTag(ctx context.Context, ref reference.NamedTagged) (*upstream, error) {
+	peer, _, err := p.find(ctx, ref.String(), func(ctx context.Context, peer *upstream) (ocispec.Descriptor, error) {
+		_, desc, err := peer.resolve(ctx, ref, ref.Tag())
+		return desc, err
+	})
+	return peer, err
+}
@@ -0,0 +1,114 @@
+package containerd
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/containerd/containerd/v2/pkg/namespaces"
+	"github.com/containerd/errdefs"
+	"github.com/distribution/reference"
+	"github.com/opencontainers/go-digest"
+)
+
+func TestPeersFind(t *testing.T) {
+	empty := newTestRegistry(t)
+	server := newTestRegistry(t)
+	_, layer := pushImage(t, server.URL, "myapp", "latest")
+
+	// The first peer doesn't have the content and the last one is unreachable.
+	p, err := newPeers(nil, []string{empty.URL, server.URL, "http://127.0.0.1:1"}, "", "", "")
+	if err != nil {
+		t.Fatalf("create peers: %v", err)
+	}
+	repo, _ := reference.WithName("myapp")
+	ctx := namespaces.WithNamespace(context.Background(), "moby")
+
+	peer, desc, err := p.findBlob(ctx, repo, layer.Digest)
+	if err != nil {
+		t.Fatalf("find blob: %v", err)
+	}
+	if peer.host != server.Listener.Addr().String() {
+		t.Errorf("expected peer %q, got %q", server.Listener.Addr().String(), peer.host)
+	}
+	if desc.Digest != layer.Digest || desc.Size != layer.Size {
+		t.Errorf("expected descriptor %+v, got %+v", layer, desc)
+	}
+
+	tagged, _ := reference.WithTag(repo, "latest")
+	if _, err = p.findTag(ctx, tagged); err != nil {
+		t.Fatalf("find tag: %v", err)
+	}
+
+	// A missing blob is not looked up again until the miss expires.
+	missing := []byte("pushed after the miss")
+	if _, _, err = p.findBlob(ctx, repo, digest.FromBytes(missing)); !errdefs.IsNotFound(err) {
+		t.Fatalf("expected not found error, got %v", err)
+	}
+	pushBlob(t, server.URL, "myapp", missing)
+	if _, _, err = p.findBlob(ctx, repo, digest.FromBytes(missing)); !errdefs.IsNotFound(err) {
+		t.Errorf("expected cached not found error, got %v", err)
+	}
+	// The miss is cached per namespace.
+	otherCtx := namespaces.WithNamespace(context.Background(), "k8s.io")
+	if _, _, err = p.findBlob(otherCtx, repo, digest.FromBytes(missing)); err != nil {
+		t.Errorf("find blob in another namespace: %v", err)
+	}
+}
+
+func TestPeersFindWithCredentials(t *testing.T) {
+	registry := newTestRegistry(t)
+	_, layer := pushImage(t, registry.URL, "myapp", "latest")
+
+	path := filepath.Join(t.TempDir(), "htpasswd")
+	if err := os.WriteFile(path, []byte(aliceHtpasswd), 0o600); err != nil {
+		t.Fatalf("write htpasswd: %v", err)
+	}
+	handler, err := NewAuthHandler(path, registry.Config.Handler)
+	if err != nil {
+		t.Fatalf("create auth handler: %v", err)
+	}
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+
+	repo, _ := reference.WithName("myapp")
+	ctx := namespaces.WithNamespace(context.Background(), "moby")
+
+	p, err := newPeers(nil, []string{server.URL}, "", "", "")
+	if err != nil {
+		t.Fatalf("create peers: %v", err)
+	}
+	if _, _, err = p.findBlob(ctx, repo, layer.Digest); !errdefs.IsNotFound(err) {
+		t.Errorf("expected not found error without credentials, got %v", err)
+	}
+
+	p, err = newPeers(nil, []string{server.URL}, "", "alice", "secret")
+	if err != nil {
+		t.Fatalf("create peers: %v", err)
+	}
+	if _, _, err = p.findBlob(ctx, repo, layer.Digest); err != nil {
+		t.Errorf("find blob with credentials: %v", err)
+	}
+}
+
+func TestPeerHandler(t *testing.T) {
+	var gotPeer bool
+	handler := NewPeerHandler(http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+		gotPeer = isPeerRequest(r.Context())
+	}))
+
+	req := httptest.NewRequest(http.MethodGet, "/v2/myapp/manifests/latest", nil)
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	if gotPeer {
+		t.Error("expected request without peer header not to be a peer request")
+	}
+
+	req.Header.Set(PeerHeader, "true")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	if !gotPeer {
+		t.Error("expected request with peer header to be a peer request")
+	}
+}
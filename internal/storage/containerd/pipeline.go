@@ -0,0 +1,556 @@
+package containerd
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/containerd/containerd/v2/client"
+	"github.com/containerd/containerd/v2/core/content"
+	"github.com/containerd/containerd/v2/core/leases"
+	"github.com/containerd/containerd/v2/pkg/archive/compression"
+	"github.com/containerd/containerd/v2/pkg/labels"
+	"github.com/containerd/containerd/v2/pkg/namespaces"
+	"github.com/containerd/containerd/v2/pkg/rootfs"
+	"github.com/containerd/errdefs"
+	"github.com/containerd/platforms"
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/identity"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// maxConfigSize is the maximum size of a blob that is inspected as a potential image config.
+	maxConfigSize = 4 << 20
+	// stagingLeasePrefix is the prefix of the upload lease label value for leases that protect staging snapshot
+	// chains. The rest of the value is the image config digest.
+	stagingLeasePrefix = "unpack-"
+)
+
+// unpackPipeline applies layers into the containerd snapshotter while a push is still uploading. The order of layers
+// is only known from the image config (rootfs.diff_ids) that references them by their uncompressed digests (diff IDs).
+// So every committed blob is inspected: the diff IDs of layers are computed while they are being uploaded and image
+// configs register staging chains. A layer is applied on top of its parent in a staging chain as soon as both
+// the layer and its parent are ready. The staging snapshots are named by chain IDs the same way containerd unpacks
+// images, so unpacking the image on tag only has to apply the layers the pipeline hasn't applied yet.
+//
+// The staging snapshots are protected from garbage collection by a lease per chain that is deleted once the image
+// is unpacked on tag. If the manifest never arrives, the lease expires after leaseExpiration or is deleted earlier
+// by the reaper as a stale upload lease.
+type unpackPipeline struct {
+	client      *client.Client
+	leases      leases.Manager
+	snapshotter string
+	platforms   platforms.MatchComparer
+	// applyFunc applies the layer on top of its parents into the snapshotter. It's applyLayer unless replaced in tests.
+	applyFunc func(ctx context.Context, layer rootfs.Layer, parents []digest.Digest) (bool, error)
+	// ctx is the context for background inspection and apply jobs that is canceled when the registry is shut down.
+	ctx context.Context
+	log *logrus.Entry
+
+	mu sync.Mutex
+	// layers maps diff IDs in their namespaces to the descriptors of the committed layer blobs.
+	layers map[namespacedDigest]stagedLayer
+	// chains maps image config digests in their namespaces to their staging chains.
+	chains map[namespacedDigest]*stagingChain
+	// hashers maps upload session IDs to the diff ID hashers of the blobs being uploaded.
+	hashers map[string]*diffIDHasher
+}
+
+type stagedLayer struct {
+	desc      ocispec.Descriptor
+	committed time.Time
+}
+
+// stagingChain is a chain of snapshots for the layers of an image config being applied by the pipeline.
+type stagingChain struct {
+	diffIDs []digest.Digest
+	lease   leases.Lease
+	// applied is the number of layers from the bottom of the chain that have been applied.
+	applied int
+	// applying is closed when the layer currently being applied is done. It's nil if no layer is being applied.
+	applying chan struct{}
+	// err is the error of the last failed apply. No more layers are applied by the pipeline after a failure.
+	err error
+}
+
+func newUnpackPipeline(
+	ctx context.Context, client *client.Client, snapshotter string, ps []ocispec.Platform,
+) *unpackPipeline {
+	p := &unpackPipeline{
+		client:      client,
+		leases:      client.LeasesService(),
+		snapshotter: snapshotter,
+		platforms:   platforms.Any(ps...),
+		ctx:         ctx,
+		log:         logrus.WithField("component", "unpack-pipeline"),
+		layers:      make(map[namespacedDigest]stagedLayer),
+		chains:      make(map[namespacedDigest]*stagingChain),
+		hashers:     make(map[string]*diffIDHasher),
+	}
+	p.applyFunc = p.applyLayer
+	return p
+}
+
+// hasher returns the diff ID hasher for the upload session with the given ID that has written offset bytes so far.
+// A new hasher is started for a new upload. It returns nil if the written data can't be hashed, e.g. the upload was
+// resumed after a restart or a failed write. It's a no-op if the pipeline is nil.
+func (p *unpackPipeline) hasher(id string, offset int64) *diffIDHasher {
+	if p == nil {
+		return nil
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if h, ok := p.hashers[id]; ok {
+		if h.written() == offset {
+			return h
+		}
+		h.close()
+		delete(p.hashers, id)
+	}
+	if offset != 0 {
+		return nil
+	}
+	h := newDiffIDHasher()
+	p.hashers[id] = h
+	return h
+}
+
+// discard stops the diff ID hasher of the upload session if the upload is canceled or the blob already exists.
+// It's a no-op if the pipeline is nil.
+func (p *unpackPipeline) discard(id string) {
+	if p == nil {
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if h, ok := p.hashers[id]; ok {
+		h.close()
+		delete(p.hashers, id)
+	}
+}
+
+// committed notifies the pipeline that a new blob has been committed to the containerd content store in
+// the namespace by the upload session with the given ID. The blob is inspected in the background. It's a no-op if
+// the pipeline is nil.
+func (p *unpackPipeline) committed(namespace, id string, dgst digest.Digest, size int64) {
+	if p == nil {
+		return
+	}
+
+	p.mu.Lock()
+	h := p.hashers[id]
+	delete(p.hashers, id)
+	p.mu.Unlock()
+	go p.inspect(namespace, ocispec.Descriptor{Digest: dgst, Size: size}, h)
+}
+
+// inspect detects whether the blob is a layer or an image config and adds it to the pipeline. The diff ID computed by
+// the hasher during the upload is used for layers if available.
+func (p *unpackPipeline) inspect(namespace string, desc ocispec.Descriptor, h *diffIDHasher) {
+	defer h.close()
+	log := p.log.WithFields(
+		logrus.Fields{
+			"namespace": namespace,
+			"digest":    desc.Digest,
+		},
+	)
+	ctx := namespaces.WithNamespace(p.ctx, namespace)
+	ra, err := p.client.ContentStore().ReaderAt(ctx, desc)
+	if err != nil {
+		log.WithError(err).Debug("Failed to open blob for inspection.")
+		return
+	}
+	defer ra.Close()
+
+	head := make([]byte, 512)
+	n, err := ra.ReadAt(head, 0)
+	if err != nil && err != io.EOF {
+		log.WithError(err).Debug("Failed to read blob for inspection.")
+		return
+	}
+	head = head[:n]
+
+	switch {
+	case bytes.HasPrefix(head, []byte("{")):
+		if desc.Size <= maxConfigSize {
+			p.inspectConfig(ctx, desc, ra)
+		}
+	case compression.DetectCompression(head) != compression.Uncompressed || isTar(head):
+		p.inspectLayer(namespace, desc, ra, compression.DetectCompression(head), h)
+	}
+}
+
+// isTar checks if the header is from an uncompressed tar archive by looking for the ustar magic.
+func isTar(head []byte) bool {
+	return len(head) >= 262 && string(head[257:262]) == "ustar"
+}
+
+// inspectLayer gets the diff ID of the layer blob and schedules applying it to the chains that need it. The blob is
+// only decompressed to compute the diff ID if the hasher couldn't compute it during the upload.
+func (p *unpackPipeline) inspectLayer(
+	namespace string, desc ocispec.Descriptor, ra content.ReaderAt, comp compression.Compression, h *diffIDHasher,
+) {
+	log := p.log.WithFields(
+		logrus.Fields{
+			"namespace": namespace,
+			"digest":    desc.Digest,
+		},
+	)
+	diffID, ok := h.sum(desc.Size)
+	if !ok {
+		reader, err := compression.DecompressStream(content.NewReader(ra))
+		if err != nil {
+			log.WithError(err).Debug("Failed to decompress layer blob.")
+			return
+		}
+		defer reader.Close()
+
+		digester := digest.Canonical.Digester()
+		if _, err = io.Copy(digester.Hash(), reader); err != nil {
+			log.WithError(err).Debug("Failed to compute diff ID of layer blob.")
+			return
+		}
+		diffID = digester.Digest()
+	}
+
+	switch comp {
+	case compression.Gzip:
+		desc.MediaType = ocispec.MediaTypeImageLayerGzip
+	case compression.Zstd:
+		desc.MediaType = ocispec.MediaTypeImageLayerZstd
+	default:
+		desc.MediaType = ocispec.MediaTypeImageLayer
+	}
+	log.WithFields(
+		logrus.Fields{
+			"diffid":   diffID,
+			"uploaded": ok,
+		},
+	).Debug("Inspected layer blob.")
+	p.addLayer(namespace, diffID, desc)
+}
+
+// addLayer adds the layer blob with the diff ID to the pipeline and advances the chains in the namespace that wait
+// for it.
+func (p *unpackPipeline) addLayer(namespace string, diffID digest.Digest, desc ocispec.Descriptor) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.pruneExpired()
+	p.layers[namespacedDigest{namespace: namespace, digest: diffID}] = stagedLayer{desc: desc, committed: time.Now()}
+	for config, chain := range p.chains {
+		if config.namespace == namespace {
+			p.advance(config, chain)
+		}
+	}
+}
+
+// inspectConfig registers a staging chain for the image config if it's for one of the pipeline platforms.
+func (p *unpackPipeline) inspectConfig(ctx context.Context, desc ocispec.Descriptor, ra content.ReaderAt) {
+	namespace, _ := namespaces.Namespace(ctx)
+	blob := make([]byte, desc.Size)
+	if _, err := ra.ReadAt(blob, 0); err != nil && err != io.EOF {
+		p.log.WithField("digest", desc.Digest).WithError(err).Debug("Failed to read blob for inspection.")
+		return
+	}
+
+	var config ocispec.Image
+	if err := json.Unmarshal(blob, &config); err != nil || config.RootFS.Type != "layers" ||
+		len(config.RootFS.DiffIDs) == 0 {
+		// Not an image config, e.g. a manifest or an artifact.
+		return
+	}
+	log := p.log.WithFields(
+		logrus.Fields{
+			"namespace": namespace,
+			"config":    desc.Digest,
+			"layers":    len(config.RootFS.DiffIDs),
+		},
+	)
+	if !p.platforms.Match(config.Platform) {
+		log.WithField("platform", platforms.Format(config.Platform)).Debug(
+			"Image config is not for an unpack platform, skipping.",
+		)
+		return
+	}
+
+	lease, err := p.leases.Create(
+		ctx,
+		leases.WithRandomID(),
+		leases.WithExpiration(leaseExpiration),
+		// The lease is deleted by the reaper as a stale upload lease if the image is never tagged.
+		leases.WithLabel(uploadLeaseLabel, stagingLeasePrefix+desc.Digest.String()),
+	)
+	if err != nil {
+		log.WithError(err).Warn("Failed to create containerd lease for staging snapshots.")
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	key := namespacedDigest{namespace: namespace, digest: desc.Digest}
+	if _, ok := p.chains[key]; ok {
+		// The same config has already been pushed by a concurrent push.
+		_ = p.leases.Delete(ctx, lease)
+		return
+	}
+	p.pruneExpired()
+	chain := &stagingChain{
+		diffIDs: config.RootFS.DiffIDs,
+		lease:   lease,
+	}
+	p.chains[key] = chain
+	log.Debug("Registered staging chain for image config.")
+	p.advance(key, chain)
+}
+
+// advance starts applying the next layer of the chain if the chain is idle and the layer is ready.
+// Must be called with the mutex held.
+func (p *unpackPipeline) advance(config namespacedDigest, chain *stagingChain) {
+	if chain.applying != nil || chain.err != nil || chain.applied == len(chain.diffIDs) {
+		return
+	}
+	layer, ok := p.layers[namespacedDigest{namespace: config.namespace, digest: chain.diffIDs[chain.applied]}]
+	if !ok {
+		return
+	}
+
+	chain.applying = make(chan struct{})
+	go p.apply(config, chain, chain.applied, layer.desc)
+}
+
+// apply applies the layer with the given index in the chain on top of its parent snapshot.
+func (p *unpackPipeline) apply(config namespacedDigest, chain *stagingChain, index int, blob ocispec.Descriptor) {
+	log := p.log.WithFields(
+		logrus.Fields{
+			"namespace": config.namespace,
+			"config":    config.digest,
+			"layer":     blob.Digest,
+			"index":     index,
+		},
+	)
+	ctx := leases.WithLease(namespaces.WithNamespace(p.ctx, config.namespace), chain.lease.ID)
+	layer := rootfs.Layer{
+		Blob: blob,
+		Diff: ocispec.Descriptor{
+			MediaType: ocispec.MediaTypeImageLayer,
+			Digest:    chain.diffIDs[index],
+		},
+	}
+
+	start := time.Now()
+	unpacked, err := p.applyFunc(ctx, layer, chain.diffIDs[:index])
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	close(chain.applying)
+	chain.applying = nil
+	if err != nil {
+		chain.err = err
+		log.WithError(err).Warn("Failed to apply layer into staging snapshot, leaving it to unpack on tag.")
+		return
+	}
+	chain.applied++
+	log.WithFields(
+		logrus.Fields{
+			"chainid":  identity.ChainID(chain.diffIDs[:index+1]),
+			"unpacked": unpacked,
+			"duration": time.Since(start),
+		},
+	).Debug("Applied layer into staging snapshot.")
+	p.advance(config, chain)
+}
+
+// applyLayer applies the layer on top of the snapshot chain of its parents into the containerd snapshotter.
+func (p *unpackPipeline) applyLayer(ctx context.Context, layer rootfs.Layer, parents []digest.Digest) (bool, error) {
+	sn := p.client.SnapshotService(p.snapshotter)
+	unpacked, err := rootfs.ApplyLayer(ctx, layer, parents, sn, p.client.DiffService())
+	if err != nil || !unpacked {
+		return unpacked, err
+	}
+	// Set the uncompressed label the same way containerd does when unpacking images.
+	info := content.Info{
+		Digest: layer.Blob.Digest,
+		Labels: map[string]string{labels.LabelUncompressed: layer.Diff.Digest.String()},
+	}
+	_, err = p.client.ContentStore().Update(ctx, info, "labels."+labels.LabelUncompressed)
+	return unpacked, err
+}
+
+// wait waits until the pipeline finishes applying layers of the chain for the image config. The layers that
+// the pipeline hasn't applied yet are left to be applied by the caller.
+func (p *unpackPipeline) wait(ctx context.Context, config digest.Digest) error {
+	if p == nil {
+		return nil
+	}
+
+	key := namespacedDigest{namespace: requestNamespace(ctx, p.client), digest: config}
+	for {
+		p.mu.Lock()
+		chain, ok := p.chains[key]
+		var applying chan struct{}
+		if ok {
+			applying = chain.applying
+		}
+		p.mu.Unlock()
+		if applying == nil {
+			return nil
+		}
+
+		select {
+		case <-applying:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// release forgets the staging chain for the image config and deletes its lease. It should be called once
+// the snapshots are protected from garbage collection by the image config labels set when unpacking the image.
+func (p *unpackPipeline) release(ctx context.Context, config digest.Digest) {
+	if p == nil {
+		return
+	}
+
+	key := namespacedDigest{namespace: requestNamespace(ctx, p.client), digest: config}
+	p.mu.Lock()
+	chain, ok := p.chains[key]
+	if ok {
+		delete(p.chains, key)
+	}
+	p.mu.Unlock()
+	if !ok {
+		return
+	}
+
+	if err := p.leases.Delete(ctx, chain.lease); err != nil && !errdefs.IsNotFound(err) {
+		p.log.WithField("config", config).WithError(err).Warn(
+			"Failed to delete containerd lease for staging snapshots.",
+		)
+	}
+}
+
+// pruneExpired forgets the layers and chains with expired leases, e.g. when the manifest never arrived, and stops
+// the hashers of abandoned uploads. Must be called with the mutex held.
+func (p *unpackPipeline) pruneExpired() {
+	for id, h := range p.hashers {
+		if time.Since(h.created) > leaseExpiration {
+			h.close()
+			delete(p.hashers, id)
+		}
+	}
+	for diffID, layer := range p.layers {
+		if time.Since(layer.committed) > leaseExpiration {
+			delete(p.layers, diffID)
+		}
+	}
+	for config, chain := range p.chains {
+		if time.Since(chain.lease.CreatedAt) > leaseExpiration && chain.applying == nil {
+			delete(p.chains, config)
+		}
+	}
+}
+
+// diffIDHasher computes the diff ID of a blob while it's being uploaded by decompressing the written data in
+// a background goroutine so that the committed layer doesn't have to be read and decompressed once more before it's
+// applied. Failing to decompress the data never fails the upload, it only makes the diff ID unavailable.
+type diffIDHasher struct {
+	created time.Time
+	pw      *io.PipeWriter
+	// done is closed when the background goroutine has finished and diffID and err are set.
+	done   chan struct{}
+	diffID digest.Digest
+	err    error
+
+	mu sync.Mutex
+	// offset is the number of bytes written to the hasher.
+	offset int64
+	// failed is set if the written data couldn't be passed to the decompressor.
+	failed bool
+}
+
+func newDiffIDHasher() *diffIDHasher {
+	pr, pw := io.Pipe()
+	h := &diffIDHasher{
+		created: time.Now(),
+		pw:      pw,
+		done:    make(chan struct{}),
+	}
+	go func() {
+		defer close(h.done)
+		reader, err := compression.DecompressStream(pr)
+		if err != nil {
+			h.err = err
+			pr.CloseWithError(err)
+			return
+		}
+		defer reader.Close()
+
+		digester := digest.Canonical.Digester()
+		if _, err = io.Copy(digester.Hash(), reader); err != nil {
+			h.err = err
+			pr.CloseWithError(err)
+			return
+		}
+		h.diffID = digester.Digest()
+		// Fail the writes of any data left after the end of the compressed stream.
+		pr.CloseWithError(io.ErrShortWrite)
+	}()
+	return h
+}
+
+// Write passes the data to the decompressor. It never returns an error to not fail the upload. It's a no-op if
+// the hasher is nil.
+func (h *diffIDHasher) Write(data []byte) (int, error) {
+	if h == nil {
+		return len(data), nil
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if !h.failed {
+		if _, err := h.pw.Write(data); err != nil {
+			h.failed = true
+		}
+	}
+	h.offset += int64(len(data))
+	return len(data), nil
+}
+
+// written returns the number of bytes written to the hasher.
+func (h *diffIDHasher) written() int64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.offset
+}
+
+// sum finishes hashing and returns the diff ID of the blob if all its size bytes have been decompressed successfully.
+// It's a no-op if the hasher is nil.
+func (h *diffIDHasher) sum(size int64) (digest.Digest, bool) {
+	if h == nil {
+		return "", false
+	}
+
+	h.close()
+	<-h.done
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.failed || h.err != nil || h.offset != size {
+		return "", false
+	}
+	return h.diffID, true
+}
+
+// close signals the end of the data to the decompressor. It's a no-op if the hasher is nil.
+func (h *diffIDHasher) close() {
+	if h == nil {
+		return
+	}
+	_ = h.pw.Close()
+}
@@ -0,0 +1,306 @@
+package containerd
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/containerd/containerd/v2/core/leases"
+	"github.com/containerd/containerd/v2/pkg/namespaces"
+	"github.com/containerd/containerd/v2/pkg/rootfs"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/sirupsen/logrus"
+)
+
+// fakeLeases is a leases.Manager that records deleted leases.
+type fakeLeases struct {
+	leases.Manager
+	mu      sync.Mutex
+	deleted []string
+}
+
+func (l *fakeLeases) Delete(_ context.Context, lease leases.Lease, _ ...leases.DeleteOpt) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.deleted = append(l.deleted, lease.ID)
+	return nil
+}
+
+// newTestPipeline returns an unpack pipeline without a containerd client that applies layers with the given function.
+func newTestPipeline(
+	applyFunc func(ctx context.Context, layer rootfs.Layer, parents []digest.Digest) (bool, error),
+) (*unpackPipeline, *fakeLeases) {
+	l := &fakeLeases{}
+	return &unpackPipeline{
+		leases:    l,
+		applyFunc: applyFunc,
+		ctx:       context.Background(),
+		log:       logrus.WithField("component", "unpack-pipeline"),
+		layers:    make(map[namespacedDigest]stagedLayer),
+		chains:    make(map[namespacedDigest]*stagingChain),
+		hashers:   make(map[string]*diffIDHasher),
+	}, l
+}
+
+// addTestChain registers a staging chain for a config with the given diff IDs in the "default" namespace.
+func addTestChain(p *unpackPipeline, config digest.Digest, diffIDs []digest.Digest) *stagingChain {
+	chain := &stagingChain{
+		diffIDs: diffIDs,
+		lease:   leases.Lease{ID: "lease-" + config.Encoded(), CreatedAt: time.Now()},
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	key := namespacedDigest{namespace: "default", digest: config}
+	p.chains[key] = chain
+	p.advance(key, chain)
+	return chain
+}
+
+func gzipData(t *testing.T, data []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(data); err != nil {
+		t.Fatalf("gzip data: %v", err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatalf("gzip data: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func TestDiffIDHasher(t *testing.T) {
+	uncompressed := bytes.Repeat([]byte("layer content "), 10000)
+	compressed := gzipData(t, uncompressed)
+
+	h := newDiffIDHasher()
+	for chunk := range slices.Chunk(compressed, 1000) {
+		if n, err := h.Write(chunk); err != nil || n != len(chunk) {
+			t.Fatalf("write chunk: n = %d, err = %v", n, err)
+		}
+	}
+	diffID, ok := h.sum(int64(len(compressed)))
+	if !ok || diffID != digest.FromBytes(uncompressed) {
+		t.Errorf("expected diff ID %s, got %s (ok: %t)", digest.FromBytes(uncompressed), diffID, ok)
+	}
+
+	// Data written to the blob writer but not to the hasher makes the diff ID unavailable.
+	h = newDiffIDHasher()
+	_, _ = h.Write(compressed)
+	if _, ok = h.sum(int64(len(compressed)) + 1); ok {
+		t.Error("expected no diff ID for size mismatch")
+	}
+
+	// Invalid compressed data must not fail writes.
+	h = newDiffIDHasher()
+	truncated := compressed[:len(compressed)/2]
+	invalid := append(append([]byte{}, truncated...), bytes.Repeat([]byte{0xff}, 100000)...)
+	if n, err := h.Write(invalid); err != nil || n != len(invalid) {
+		t.Fatalf("write invalid data: n = %d, err = %v", n, err)
+	}
+	if _, ok = h.sum(int64(len(invalid))); ok {
+		t.Error("expected no diff ID for invalid compressed data")
+	}
+}
+
+func TestUnpackPipelineHasher(t *testing.T) {
+	p, _ := newTestPipeline(nil)
+
+	h := p.hasher("session", 0)
+	if h == nil {
+		t.Fatal("expected hasher for new upload")
+	}
+	_, _ = h.Write([]byte("data"))
+	if resumed := p.hasher("session", 4); resumed != h {
+		t.Error("expected the same hasher for upload resumed at the written offset")
+	}
+	// The hasher can't continue if the upload is resumed at another offset, e.g. after a failed write.
+	if resumed := p.hasher("session", 2); resumed != nil {
+		t.Error("expected no hasher for upload resumed at another offset")
+	}
+	if _, ok := p.hashers["session"]; ok {
+		t.Error("hasher for upload resumed at another offset must be discarded")
+	}
+	// The hasher is lost on restart so a resumed upload can't be hashed.
+	if resumed := p.hasher("other", 10); resumed != nil {
+		t.Error("expected no hasher for unknown upload resumed at non-zero offset")
+	}
+
+	p.hasher("canceled", 0)
+	p.discard("canceled")
+	if _, ok := p.hashers["canceled"]; ok {
+		t.Error("discarded hasher must be removed")
+	}
+
+	var nilPipeline *unpackPipeline
+	if nilPipeline.hasher("session", 0) != nil {
+		t.Error("expected no hasher for disabled pipeline")
+	}
+}
+
+func TestUnpackPipelineAppliesLayersInOrder(t *testing.T) {
+	var mu sync.Mutex
+	var applied []digest.Digest
+	var parents []int
+	p, _ := newTestPipeline(func(_ context.Context, layer rootfs.Layer, ps []digest.Digest) (bool, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		applied = append(applied, layer.Diff.Digest)
+		parents = append(parents, len(ps))
+		return true, nil
+	})
+	ctx := namespaces.WithNamespace(context.Background(), "default")
+	diffIDs := []digest.Digest{digest.FromString("a"), digest.FromString("b"), digest.FromString("c")}
+	config := digest.FromString("config")
+	chain := addTestChain(p, config, diffIDs)
+
+	// Layers committed out of order are applied in the order of the chain once their parents are applied.
+	for _, i := range []int{2, 0, 1} {
+		p.addLayer("default", diffIDs[i], ocispec.Descriptor{Digest: digest.FromString("blob" + string(rune('a'+i)))})
+	}
+	// A layer with the same diff ID in another namespace isn't used.
+	p.addLayer("other", diffIDs[0], ocispec.Descriptor{})
+
+	if err := p.wait(ctx, config); err != nil {
+		t.Fatalf("wait: %v", err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(applied) != len(diffIDs) {
+		t.Fatalf("expected %d applied layers, got %d", len(diffIDs), len(applied))
+	}
+	for i := range diffIDs {
+		if applied[i] != diffIDs[i] || parents[i] != i {
+			t.Errorf("layer %d: expected %s with %d parents, got %s with %d parents",
+				i, diffIDs[i], i, applied[i], parents[i])
+		}
+	}
+	if chain.applied != len(diffIDs) {
+		t.Errorf("expected %d applied layers in chain, got %d", len(diffIDs), chain.applied)
+	}
+}
+
+func TestUnpackPipelineStopsAfterFailure(t *testing.T) {
+	calls := 0
+	p, _ := newTestPipeline(func(context.Context, rootfs.Layer, []digest.Digest) (bool, error) {
+		calls++
+		return false, errors.New("apply failed")
+	})
+	ctx := namespaces.WithNamespace(context.Background(), "default")
+	diffIDs := []digest.Digest{digest.FromString("a"), digest.FromString("b")}
+	config := digest.FromString("config")
+	chain := addTestChain(p, config, diffIDs)
+
+	p.addLayer("default", diffIDs[0], ocispec.Descriptor{})
+	if err := p.wait(ctx, config); err != nil {
+		t.Fatalf("wait: %v", err)
+	}
+	p.addLayer("default", diffIDs[1], ocispec.Descriptor{})
+	if err := p.wait(ctx, config); err != nil {
+		t.Fatalf("wait: %v", err)
+	}
+
+	// The remaining layers are left to unpack on tag.
+	if calls != 1 || chain.applied != 0 || chain.err == nil {
+		t.Errorf("expected one failed apply, got %d calls, %d applied, err: %v", calls, chain.applied, chain.err)
+	}
+}
+
+func TestUnpackPipelineWaitCanceled(t *testing.T) {
+	unblock := make(chan struct{})
+	p, _ := newTestPipeline(func(context.Context, rootfs.Layer, []digest.Digest) (bool, error) {
+		<-unblock
+		return true, nil
+	})
+	diffIDs := []digest.Digest{digest.FromString("a")}
+	config := digest.FromString("config")
+	addTestChain(p, config, diffIDs)
+	p.addLayer("default", diffIDs[0], ocispec.Descriptor{})
+
+	ctx, cancel := context.WithCancel(namespaces.WithNamespace(context.Background(), "default"))
+	cancel()
+	if err := p.wait(ctx, config); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected context canceled error, got %v", err)
+	}
+
+	close(unblock)
+	if err := p.wait(namespaces.WithNamespace(context.Background(), "default"), config); err != nil {
+		t.Fatalf("wait: %v", err)
+	}
+}
+
+func TestUnpackPipelineRelease(t *testing.T) {
+	p, l := newTestPipeline(nil)
+	config := digest.FromString("config")
+	chain := addTestChain(p, config, []digest.Digest{digest.FromString("a")})
+
+	otherCtx := namespaces.WithNamespace(context.Background(), "other")
+	p.release(otherCtx, config)
+	if len(l.deleted) != 0 {
+		t.Errorf("chain in another namespace must not be released, deleted leases: %v", l.deleted)
+	}
+
+	ctx := namespaces.WithNamespace(context.Background(), "default")
+	p.release(ctx, config)
+	if len(p.chains) != 0 {
+		t.Error("released chain must be forgotten")
+	}
+	if len(l.deleted) != 1 || l.deleted[0] != chain.lease.ID {
+		t.Errorf("expected lease %s to be deleted, got %v", chain.lease.ID, l.deleted)
+	}
+	// Releasing an unknown chain is a no-op.
+	p.release(ctx, config)
+	if len(l.deleted) != 1 {
+		t.Errorf("expected no more deleted leases, got %v", l.deleted)
+	}
+}
+
+func TestUnpackPipelinePruneExpired(t *testing.T) {
+	p, _ := newTestPipeline(nil)
+	expired := time.Now().Add(-leaseExpiration - time.Minute)
+
+	p.layers[namespacedDigest{namespace: "default", digest: digest.FromString("old")}] = stagedLayer{committed: expired}
+	p.layers[namespacedDigest{namespace: "default", digest: digest.FromString("new")}] = stagedLayer{
+		committed: time.Now(),
+	}
+	p.chains[namespacedDigest{namespace: "default", digest: digest.FromString("old")}] = &stagingChain{
+		lease: leases.Lease{CreatedAt: expired},
+	}
+	// A chain with a layer being applied is kept until the apply finishes.
+	p.chains[namespacedDigest{namespace: "default", digest: digest.FromString("applying")}] = &stagingChain{
+		lease:    leases.Lease{CreatedAt: expired},
+		applying: make(chan struct{}),
+	}
+	old := newDiffIDHasher()
+	old.created = expired
+	p.hashers["old"] = old
+	p.hashers["new"] = newDiffIDHasher()
+
+	p.mu.Lock()
+	p.pruneExpired()
+	p.mu.Unlock()
+
+	if _, ok := p.layers[namespacedDigest{namespace: "default", digest: digest.FromString("new")}]; !ok ||
+		len(p.layers) != 1 {
+		t.Errorf("expected only the new layer to be kept, got %v", p.layers)
+	}
+	if _, ok := p.chains[namespacedDigest{namespace: "default", digest: digest.FromString("applying")}]; !ok ||
+		len(p.chains) != 1 {
+		t.Errorf("expected only the applying chain to be kept, got %v", p.chains)
+	}
+	if _, ok := p.hashers["new"]; !ok || len(p.hashers) != 1 {
+		t.Errorf("expected only the new hasher to be kept, got %v", p.hashers)
+	}
+	// The pruned hasher is stopped.
+	select {
+	case <-old.done:
+	case <-time.After(5 * time.Second):
+		t.Error("pruned hasher must be stopped")
+	}
+}
@@ -0,0 +1,160 @@
+package containerd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/containerd/containerd/v2/client"
+	"github.com/containerd/containerd/v2/pkg/namespaces"
+	"github.com/containerd/errdefs"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// uploadLeaseLabel is the label set on containerd leases created by blob writers to identify them as unregistry
+	// upload leases. The value is the upload session ID, or the upstream registry host prefixed with upstreamRefPrefix
+	// for leases protecting content fetched from an upstream registry or a peer.
+	uploadLeaseLabel = "unregistry.io/upload"
+	// uploadRefPrefix is the prefix of containerd ingest refs used by blob writers.
+	uploadRefPrefix = "upload-"
+	// reapInterval is how often the reaper looks for stale uploads after the initial run on startup.
+	reapInterval = 10 * time.Minute
+)
+
+// reaper cleans up containerd resources left behind by interrupted uploads, for example, when unregistry is killed
+// in the middle of a push: partially written ingests and leases created by blob writers.
+type reaper struct {
+	client *client.Client
+	// maxAge is the age after which an ingest that hasn't been updated or an upload lease is considered stale.
+	maxAge time.Duration
+	// namespaces are the containerd namespaces to reap stale uploads in.
+	namespaces []string
+	log        *logrus.Entry
+}
+
+func newReaper(client *client.Client, maxAge time.Duration, namespaces []string) *reaper {
+	return &reaper{
+		client:     client,
+		maxAge:     maxAge,
+		namespaces: namespaces,
+		log:        logrus.WithField("component", "reaper"),
+	}
+}
+
+// run reaps stale uploads immediately and then every reapInterval until the context is canceled.
+func (r *reaper) run(ctx context.Context) {
+	r.reap(ctx)
+
+	ticker := time.NewTicker(reapInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			r.reap(ctx)
+		}
+	}
+}
+
+// reap aborts stale upload ingests and deletes stale upload leases in each namespace.
+func (r *reaper) reap(ctx context.Context) {
+	for _, ns := range r.namespaces {
+		r.reapNamespace(namespaces.WithNamespace(ctx, ns), ns)
+	}
+}
+
+func (r *reaper) reapNamespace(ctx context.Context, namespace string) {
+	ingests, reclaimed, ingestsErr := r.abortStaleIngests(ctx)
+	leases, leasesErr := r.deleteStaleLeases(ctx)
+	if err := errors.Join(ingestsErr, leasesErr); err != nil {
+		r.log.WithField("namespace", namespace).WithError(err).Warn("Failed to reap some stale uploads.")
+	}
+
+	log := r.log.WithFields(
+		logrus.Fields{
+			"namespace": namespace,
+			"ingests":   ingests,
+			"leases":    leases,
+			"reclaimed": reclaimed,
+		},
+	)
+	if ingests > 0 || leases > 0 {
+		log.Info("Reaped stale uploads in containerd.")
+	} else {
+		log.Debug("No stale uploads found in containerd.")
+	}
+}
+
+// abortStaleIngests aborts the upload ingests and the ingests of content fetched from an upstream registry or a peer
+// in the containerd content store that haven't been updated for maxAge.
+// It returns the number of aborted ingests and the number of bytes reclaimed.
+func (r *reaper) abortStaleIngests(ctx context.Context) (int, int64, error) {
+	contentStore := r.client.ContentStore()
+	statuses, err := contentStore.ListStatuses(
+		ctx, "ref~="+strconv.Quote("^"+uploadRefPrefix), "ref~="+strconv.Quote("^"+upstreamRefPrefix),
+	)
+	if err != nil {
+		return 0, 0, fmt.Errorf("list ingests in containerd content store: %w", err)
+	}
+
+	var aborted int
+	var reclaimed int64
+	var errs error
+	for _, status := range statuses {
+		if time.Since(status.UpdatedAt) < r.maxAge {
+			continue
+		}
+		if err = contentStore.Abort(ctx, status.Ref); err != nil && !errdefs.IsNotFound(err) {
+			errs = errors.Join(errs, fmt.Errorf("abort ingest '%s': %w", status.Ref, err))
+			continue
+		}
+		r.log.WithFields(
+			logrus.Fields{
+				"ref":     status.Ref,
+				"size":    status.Offset,
+				"updated": status.UpdatedAt,
+			},
+		).Debug("Aborted stale upload ingest in containerd content store.")
+
+		aborted++
+		reclaimed += status.Offset
+	}
+
+	return aborted, reclaimed, errs
+}
+
+// deleteStaleLeases deletes the upload leases created by blob writers more than maxAge ago. It returns the number of
+// deleted leases.
+func (r *reaper) deleteStaleLeases(ctx context.Context) (int, error) {
+	leasesService := r.client.LeasesService()
+	uploadLeases, err := leasesService.List(ctx, "labels."+strconv.Quote(uploadLeaseLabel))
+	if err != nil {
+		return 0, fmt.Errorf("list containerd leases: %w", err)
+	}
+
+	var deleted int
+	var errs error
+	for _, lease := range uploadLeases {
+		if time.Since(lease.CreatedAt) < r.maxAge {
+			continue
+		}
+		if err = leasesService.Delete(ctx, lease); err != nil && !errdefs.IsNotFound(err) {
+			errs = errors.Join(errs, fmt.Errorf("delete lease '%s': %w", lease.ID, err))
+			continue
+		}
+		r.log.WithFields(
+			logrus.Fields{
+				"lease":   lease.ID,
+				"created": lease.CreatedAt,
+			},
+		).Debug("Deleted stale upload lease in containerd.")
+
+		deleted++
+	}
+
+	return deleted, errs
+}
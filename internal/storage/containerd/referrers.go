@@ -0,0 +1,287 @@
+package containerd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/containerd/containerd/v2/client"
+	"github.com/containerd/containerd/v2/core/content"
+	"github.com/containerd/containerd/v2/core/images"
+	"github.com/containerd/errdefs"
+	"github.com/distribution/distribution/v3/registry/api/errcode"
+	"github.com/distribution/reference"
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// subjectLabel is the label set on a referrer manifest in the containerd content store. The value is the digest
+	// of the manifest's subject. It's used to look up the referrers of a subject.
+	subjectLabel = "unregistry.io/subject"
+	// referrerGCLabelPrefix is the prefix of the garbage collection labels set on a subject manifest in the containerd
+	// content store referencing its referrers. It prevents the referrers from being deleted by GC while the subject
+	// is referenced, e.g. by an image.
+	referrerGCLabelPrefix = "containerd.io/gc.ref.content.referrer."
+	// artifactTypeFilter is the name of the query parameter to filter referrers by artifact type.
+	artifactTypeFilter = "artifactType"
+)
+
+// referrersPathRegexp matches the path of the OCI referrers API endpoint: /v2/<name>/referrers/<digest>.
+var referrersPathRegexp = regexp.MustCompile(`^/v2/(` + reference.NameRegexp.String() + `)/referrers/([^/]+)$`)
+
+// manifestPathRegexp matches the path of the manifest endpoint: /v2/<name>/manifests/<reference>.
+var manifestPathRegexp = regexp.MustCompile(`^/v2/(` + reference.NameRegexp.String() + `)/manifests/[^/]+$`)
+
+// manifestSubjectKey is the context key for the subject digest of the manifest pushed in the request.
+type manifestSubjectKey struct{}
+
+// indexReferrers records the subject-referrer relationships for the manifest stored in the containerd content store:
+//   - If the manifest has a subject, it's labeled with the subject digest and the content it references is protected
+//     from garbage collection as the manifest itself is usually not tagged. The subject, if exists, gets a GC label
+//     referencing the manifest.
+//   - The manifest gets GC labels referencing its referrers that were pushed before it.
+//
+// It returns the subject of the manifest or nil if it doesn't have one.
+func indexReferrers(
+	ctx context.Context, contentStore content.Store, desc ocispec.Descriptor, payload []byte,
+) (*ocispec.Descriptor, error) {
+	var manifest struct {
+		Subject *ocispec.Descriptor `json:"subject,omitempty"`
+	}
+	if err := json.Unmarshal(payload, &manifest); err != nil {
+		return nil, fmt.Errorf("unmarshal manifest: %w", err)
+	}
+
+	if manifest.Subject != nil {
+		childrenHandler := images.ChildrenHandler(contentStore)
+		setGCLabelsHandler := images.SetChildrenMappedLabels(contentStore, childrenHandler, nil)
+		if err := images.Dispatch(ctx, setGCLabelsHandler, nil, desc); err != nil {
+			return nil, fmt.Errorf(
+				"set garbage collection labels for content of referrer '%s': %w", desc.Digest, err,
+			)
+		}
+
+		info := content.Info{
+			Digest: desc.Digest,
+			Labels: map[string]string{subjectLabel: manifest.Subject.Digest.String()},
+		}
+		if _, err := contentStore.Update(ctx, info, "labels."+subjectLabel); err != nil {
+			return nil, fmt.Errorf("set subject label for referrer '%s': %w", desc.Digest, err)
+		}
+
+		if err := addReferrerGCLabels(ctx, contentStore, manifest.Subject.Digest, desc.Digest); err != nil {
+			if !errdefs.IsNotFound(err) {
+				return nil, err
+			}
+			// The subject will get the GC label when it's pushed.
+		}
+	}
+
+	referrers, err := findReferrers(ctx, contentStore, desc.Digest)
+	if err != nil {
+		return nil, err
+	}
+	var referrerDigests []digest.Digest
+	for _, r := range referrers {
+		referrerDigests = append(referrerDigests, r.Digest)
+	}
+	if err = addReferrerGCLabels(ctx, contentStore, desc.Digest, referrerDigests...); err != nil {
+		return nil, err
+	}
+
+	logrus.WithFields(
+		logrus.Fields{
+			"digest":    desc.Digest,
+			"subject":   manifest.Subject,
+			"referrers": len(referrerDigests),
+		},
+	).Debug("Indexed referrers for manifest in containerd content store.")
+
+	return manifest.Subject, nil
+}
+
+// addReferrerGCLabels sets the garbage collection labels on the subject content referencing its referrers.
+func addReferrerGCLabels(
+	ctx context.Context, contentStore content.Store, subject digest.Digest, referrers ...digest.Digest,
+) error {
+	if len(referrers) == 0 {
+		return nil
+	}
+
+	info := content.Info{
+		Digest: subject,
+		Labels: make(map[string]string),
+	}
+	var fields []string
+	for _, r := range referrers {
+		key := referrerGCLabelPrefix + r.String()
+		info.Labels[key] = r.String()
+		fields = append(fields, "labels."+key)
+	}
+	if _, err := contentStore.Update(ctx, info, fields...); err != nil {
+		return fmt.Errorf("set referrer garbage collection labels for subject '%s': %w", subject, err)
+	}
+
+	return nil
+}
+
+// findReferrers returns the descriptors of manifests in the containerd content store that have the given subject
+// sorted by digest. The descriptors include the artifact type and annotations of the referrers as required by
+// the OCI referrers API.
+func findReferrers(ctx context.Context, contentStore content.Store, subject digest.Digest) (
+	[]ocispec.Descriptor, error,
+) {
+	var infos []content.Info
+	filter := "labels." + strconv.Quote(subjectLabel) + "==" + strconv.Quote(subject.String())
+	if err := contentStore.Walk(ctx, func(info content.Info) error {
+		infos = append(infos, info)
+		return nil
+	}, filter); err != nil {
+		return nil, fmt.Errorf("find referrers of '%s' in containerd content store: %w", subject, err)
+	}
+
+	referrers := make([]ocispec.Descriptor, 0, len(infos))
+	for _, info := range infos {
+		blob, err := content.ReadBlob(ctx, contentStore, ocispec.Descriptor{Digest: info.Digest})
+		if err != nil {
+			if errdefs.IsNotFound(err) {
+				continue
+			}
+			return nil, fmt.Errorf("read referrer '%s' from containerd content store: %w", info.Digest, err)
+		}
+
+		// ocispec.Manifest can be used to unmarshal the common fields of both image manifests and indexes.
+		var manifest ocispec.Manifest
+		if err = json.Unmarshal(blob, &manifest); err != nil {
+			return nil, fmt.Errorf("unmarshal referrer '%s': %w", info.Digest, err)
+		}
+
+		artifactType := manifest.ArtifactType
+		if artifactType == "" {
+			// The config media type is used as the artifact type for image manifests without the artifactType field.
+			artifactType = manifest.Config.MediaType
+		}
+		referrers = append(referrers, ocispec.Descriptor{
+			MediaType:    manifest.MediaType,
+			Digest:       info.Digest,
+			Size:         info.Size,
+			ArtifactType: artifactType,
+			Annotations:  manifest.Annotations,
+		})
+	}
+	slices.SortFunc(referrers, func(a, b ocispec.Descriptor) int {
+		return strings.Compare(a.Digest.String(), b.Digest.String())
+	})
+
+	return referrers, nil
+}
+
+// setManifestSubject records the subject of the manifest pushed in the request so that the referrers handler sets
+// the OCI-Subject header in the response. It's a no-op if the request isn't passed through the referrers handler.
+func setManifestSubject(ctx context.Context, subject digest.Digest) {
+	if s, ok := ctx.Value(manifestSubjectKey{}).(*digest.Digest); ok {
+		*s = subject
+	}
+}
+
+// subjectResponseWriter sets the OCI-Subject header to the subject of the pushed manifest, if any, before writing
+// the response header.
+type subjectResponseWriter struct {
+	http.ResponseWriter
+	subject     *digest.Digest
+	wroteHeader bool
+}
+
+func (w *subjectResponseWriter) WriteHeader(code int) {
+	if !w.wroteHeader && *w.subject != "" {
+		w.Header().Set("OCI-Subject", w.subject.String())
+	}
+	w.wroteHeader = true
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *subjectResponseWriter) Write(data []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(data)
+}
+
+// referrersHandler serves the OCI referrers API endpoint that is not supported by the distribution registry and
+// passes all other requests to the next handler.
+type referrersHandler struct {
+	client *client.Client
+	next   http.Handler
+}
+
+// NewReferrersHandler returns an http.Handler that serves the OCI referrers API (GET /v2/<name>/referrers/<digest>)
+// using the containerd content store and passes all other requests to next. The responses to manifest pushes get
+// the OCI-Subject header if the manifest has a subject.
+func NewReferrersHandler(client *client.Client, next http.Handler) http.Handler {
+	return &referrersHandler{
+		client: client,
+		next:   next,
+	}
+}
+
+func (h *referrersHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPut && manifestPathRegexp.MatchString(r.URL.Path) {
+		var subject digest.Digest
+		ctx := context.WithValue(r.Context(), manifestSubjectKey{}, &subject)
+		h.next.ServeHTTP(&subjectResponseWriter{ResponseWriter: w, subject: &subject}, r.WithContext(ctx))
+		return
+	}
+
+	match := referrersPathRegexp.FindStringSubmatch(r.URL.Path)
+	if match == nil || (r.Method != http.MethodGet && r.Method != http.MethodHead) {
+		h.next.ServeHTTP(w, r)
+		return
+	}
+
+	dgst, err := digest.Parse(match[len(match)-1])
+	if err != nil {
+		_ = errcode.ServeJSON(w, errcode.ErrorCodeDigestInvalid.WithDetail(err))
+		return
+	}
+
+	ctx := r.Context()
+	referrers, err := findReferrers(ctx, h.client.ContentStore(), dgst)
+	if err != nil {
+		logrus.WithField("subject", dgst).WithError(err).Error("Failed to find referrers.")
+		_ = errcode.ServeJSON(w, errcode.ErrorCodeUnknown.WithDetail(err))
+		return
+	}
+
+	if artifactType := r.URL.Query().Get(artifactTypeFilter); artifactType != "" {
+		referrers = slices.DeleteFunc(referrers, func(desc ocispec.Descriptor) bool {
+			return desc.ArtifactType != artifactType
+		})
+		w.Header().Set("OCI-Filters-Applied", artifactTypeFilter)
+	}
+
+	index := ocispec.Index{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ocispec.MediaTypeImageIndex,
+		Manifests: referrers,
+	}
+	payload, err := json.Marshal(index)
+	if err != nil {
+		_ = errcode.ServeJSON(w, errcode.ErrorCodeUnknown.WithDetail(err))
+		return
+	}
+
+	w.Header().Set("Content-Type", ocispec.MediaTypeImageIndex)
+	w.Header().Set("Content-Length", strconv.Itoa(len(payload)))
+	w.WriteHeader(http.StatusOK)
+	if r.Method == http.MethodGet {
+		_, _ = w.Write(payload)
+	}
+}
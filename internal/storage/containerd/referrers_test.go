@@ -0,0 +1,39 @@
+package containerd
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+)
+
+func TestReferrersHandlerSetsSubjectHeader(t *testing.T) {
+	subject := digest.FromString("subject")
+	handler := NewReferrersHandler(nil, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("subject") != "" {
+			setManifestSubject(r.Context(), subject)
+		}
+		w.WriteHeader(http.StatusCreated)
+	}))
+
+	tests := []struct {
+		name   string
+		method string
+		target string
+		want   string
+	}{
+		{"manifest with subject", http.MethodPut, "/v2/myapp/manifests/latest?subject=1", subject.String()},
+		{"manifest without subject", http.MethodPut, "/v2/myapp/manifests/latest", ""},
+		{"not a manifest push", http.MethodPut, "/v2/myapp/blobs/uploads/id?subject=1", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, httptest.NewRequest(tt.method, tt.target, nil))
+			if got := rec.Header().Get("OCI-Subject"); got != tt.want {
+				t.Errorf("OCI-Subject = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
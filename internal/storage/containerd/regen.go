@@ -0,0 +1,513 @@
+package containerd
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/containerd/containerd/v2/client"
+	"github.com/containerd/containerd/v2/core/content"
+	"github.com/containerd/containerd/v2/core/diff"
+	"github.com/containerd/containerd/v2/core/images"
+	"github.com/containerd/containerd/v2/core/leases"
+	"github.com/containerd/containerd/v2/pkg/labels"
+	"github.com/containerd/containerd/v2/pkg/rootfs"
+	"github.com/containerd/errdefs"
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/identity"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sync/singleflight"
+)
+
+// layerRegenerator recreates layer blobs that containerd deleted from the content store after unpacking them
+// (discard_unpacked_layers = true in the CRI plugin config, e.g. on k3s) from the unpacked snapshots.
+//
+// A layer regenerated with the containerd diff service is almost never identical to the original blob as it depends
+// on the tar and compression implementations and settings. In this case the manifest (and the config if the
+// uncompressed digest differs too) is rewritten to reference the regenerated layers. The rewritten manifest is
+// served instead of the original one when the image is pulled by tag. Pulls by the original manifest digest can't
+// be served and fail with an error explaining why.
+//
+// The regenerated and rewritten content is protected from garbage collection by an expiring lease so that the image
+// in containerd isn't modified. The rewritten manifests and replaced layers are remembered until the lease expires.
+type layerRegenerator struct {
+	client      *client.Client
+	snapshotter string
+	log         *logrus.Entry
+	// repairs deduplicates concurrent repairs of the same manifest or index so that its layers are regenerated once.
+	repairs singleflight.Group
+
+	// mu protects rewritten and replaced. It's held only to access the maps and not while repairing.
+	mu sync.RWMutex
+	// rewritten maps digests of original manifests and indexes with discarded layers in their namespaces to their
+	// rewritten versions.
+	rewritten map[namespacedDigest]rewrittenDescriptor
+	// replaced maps digests of discarded layers in their namespaces to the digests of regenerated layers that differ
+	// from the original.
+	replaced map[namespacedDigest]replacedLayer
+}
+
+// rewrittenDescriptor is the descriptor of a rewritten manifest or index and the time it was rewritten.
+type rewrittenDescriptor struct {
+	desc    ocispec.Descriptor
+	created time.Time
+}
+
+// replacedLayer is the digest of a regenerated layer replacing a discarded one and the time it was regenerated.
+type replacedLayer struct {
+	digest  digest.Digest
+	created time.Time
+}
+
+func newLayerRegenerator(client *client.Client, snapshotter string) (*layerRegenerator, error) {
+	if snapshotter == "" {
+		return nil, fmt.Errorf("snapshotter is required to regenerate layers")
+	}
+
+	return &layerRegenerator{
+		client:      client,
+		snapshotter: snapshotter,
+		log:         logrus.WithField("component", "layer-regenerator"),
+		rewritten:   make(map[namespacedDigest]rewrittenDescriptor),
+		replaced:    make(map[namespacedDigest]replacedLayer),
+	}, nil
+}
+
+// replacement returns the digest of the regenerated layer that replaces the discarded layer with the given digest in
+// rewritten manifests.
+func (r *layerRegenerator) replacement(ctx context.Context, dgst digest.Digest) (digest.Digest, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	replaced, ok := r.replaced[namespacedDigest{namespace: requestNamespace(ctx, r.client), digest: dgst}]
+	if !ok || time.Since(replaced.created) >= leaseExpiration {
+		return "", false
+	}
+	return replaced.digest, true
+}
+
+// setReplacement remembers the regenerated layer that replaces the discarded layer in rewritten manifests.
+func (r *layerRegenerator) setReplacement(key namespacedDigest, replacement digest.Digest) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.pruneExpired()
+	r.replaced[key] = replacedLayer{digest: replacement, created: time.Now()}
+}
+
+// cachedRewrite returns the rewritten version of the manifest or index if it has been rewritten before.
+func (r *layerRegenerator) cachedRewrite(key namespacedDigest) (ocispec.Descriptor, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	rewritten, ok := r.rewritten[key]
+	if !ok || time.Since(rewritten.created) >= leaseExpiration {
+		return ocispec.Descriptor{}, false
+	}
+	return rewritten.desc, true
+}
+
+// setRewrite remembers the rewritten version of the manifest or index.
+func (r *layerRegenerator) setRewrite(key namespacedDigest, rewritten ocispec.Descriptor) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.pruneExpired()
+	r.rewritten[key] = rewrittenDescriptor{desc: rewritten, created: time.Now()}
+}
+
+// pruneExpired removes the rewritten manifests and replaced layers whose lease has expired so that the maps don't
+// grow indefinitely. Must be called with the mutex held.
+func (r *layerRegenerator) pruneExpired() {
+	for key, rewritten := range r.rewritten {
+		if time.Since(rewritten.created) >= leaseExpiration {
+			delete(r.rewritten, key)
+		}
+	}
+	for key, replaced := range r.replaced {
+		if time.Since(replaced.created) >= leaseExpiration {
+			delete(r.replaced, key)
+		}
+	}
+}
+
+// repair regenerates the discarded layers of the image manifest or index and returns the descriptor of the manifest
+// or index that references only existing content. It's the same descriptor if no layers were discarded or all of them
+// were regenerated identically. Concurrent repairs of the same manifest or index wait for the first one to complete.
+func (r *layerRegenerator) repair(ctx context.Context, desc ocispec.Descriptor) (ocispec.Descriptor, error) {
+	contentStore := r.client.ContentStore()
+	key := namespacedDigest{namespace: requestNamespace(ctx, r.client), digest: desc.Digest}
+	if rewritten, ok := r.cachedRewrite(key); ok {
+		if _, err := contentStore.Info(ctx, rewritten.Digest); err == nil {
+			return rewritten, nil
+		}
+		// The rewritten content has been deleted, e.g. the lease protecting it has expired. Repair it again.
+	}
+
+	// Most images don't have discarded layers so check it before creating a lease and waiting for other repairs.
+	missing, err := r.missingLayers(ctx, desc)
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	if !missing {
+		return desc, nil
+	}
+
+	repaired, err, _ := r.repairs.Do(key.namespace+"@"+key.digest.String(), func() (any, error) {
+		// Other requests may wait for the repair so don't cancel it if the request that started it is canceled.
+		return r.repairMissing(context.WithoutCancel(ctx), key, desc)
+	})
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	return repaired.(ocispec.Descriptor), nil
+}
+
+// missingLayers checks if any layer of the image manifest or index is missing in the containerd content store.
+// Missing manifests of a partially available multi-platform image are ignored.
+func (r *layerRegenerator) missingLayers(ctx context.Context, desc ocispec.Descriptor) (bool, error) {
+	contentStore := r.client.ContentStore()
+	childrenHandler := images.ChildrenHandler(contentStore)
+	var missing bool
+	handler := images.HandlerFunc(func(ctx context.Context, desc ocispec.Descriptor) ([]ocispec.Descriptor, error) {
+		if !images.IsLayerType(desc.MediaType) {
+			children, err := childrenHandler(ctx, desc)
+			if err != nil && errdefs.IsNotFound(err) {
+				return nil, images.ErrSkipDesc
+			}
+			return children, err
+		}
+		if _, err := contentStore.Info(ctx, desc.Digest); err != nil {
+			if !errdefs.IsNotFound(err) {
+				return nil, fmt.Errorf("get info for layer '%s' from containerd content store: %w", desc.Digest, err)
+			}
+			missing = true
+		}
+		return nil, nil
+	})
+	if err := images.Walk(ctx, handler, desc); err != nil {
+		return false, err
+	}
+	return missing, nil
+}
+
+// repairMissing regenerates the discarded layers of the image manifest or index under a new lease.
+func (r *layerRegenerator) repairMissing(
+	ctx context.Context, key namespacedDigest, desc ocispec.Descriptor,
+) (ocispec.Descriptor, error) {
+	contentStore := r.client.ContentStore()
+	// The manifest or index may have been repaired by a concurrent request that completed in the meantime.
+	if rewritten, ok := r.cachedRewrite(key); ok {
+		if _, err := contentStore.Info(ctx, rewritten.Digest); err == nil {
+			return rewritten, nil
+		}
+	}
+
+	lease, err := r.client.LeasesService().Create(ctx, leases.WithRandomID(), leases.WithExpiration(leaseExpiration))
+	if err != nil {
+		return ocispec.Descriptor{}, fmt.Errorf("create containerd lease: %w", err)
+	}
+	ctx = leases.WithLease(ctx, lease.ID)
+
+	repaired, err := r.repairDescriptor(ctx, desc)
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	if repaired.Digest == desc.Digest {
+		// Layers regenerated identically may not be referenced by the manifest GC labels as containerd drops them when
+		// discarding unpacked layers, so the lease is only deleted if nothing has been regenerated.
+		if resources, err := r.client.LeasesService().ListResources(ctx, lease); err == nil && len(resources) == 0 {
+			_ = r.client.LeasesService().Delete(ctx, lease)
+		}
+		return desc, nil
+	}
+
+	// Protect the rewritten content from garbage collection the same way image content is protected on tag.
+	childrenHandler := images.ChildrenHandler(contentStore)
+	setGCLabelsHandler := images.SetChildrenMappedLabels(contentStore, childrenHandler, nil)
+	if err = images.Dispatch(ctx, setGCLabelsHandler, nil, repaired); err != nil {
+		return ocispec.Descriptor{}, fmt.Errorf(
+			"set garbage collection labels for rewritten manifest '%s': %w", repaired.Digest, err,
+		)
+	}
+	r.setRewrite(key, repaired)
+	r.log.WithFields(
+		logrus.Fields{
+			"original":  desc.Digest,
+			"rewritten": repaired.Digest,
+		},
+	).Info("Rewrote manifest to reference layers regenerated from snapshots.")
+
+	return repaired, nil
+}
+
+// repairDescriptor repairs the manifest or index recursively.
+func (r *layerRegenerator) repairDescriptor(ctx context.Context, desc ocispec.Descriptor) (ocispec.Descriptor, error) {
+	switch {
+	case images.IsIndexType(desc.MediaType):
+		return r.repairIndex(ctx, desc)
+	case images.IsManifestType(desc.MediaType):
+		return r.repairManifest(ctx, desc)
+	default:
+		return desc, nil
+	}
+}
+
+func (r *layerRegenerator) repairIndex(ctx context.Context, desc ocispec.Descriptor) (ocispec.Descriptor, error) {
+	contentStore := r.client.ContentStore()
+	blob, err := content.ReadBlob(ctx, contentStore, desc)
+	if err != nil {
+		return ocispec.Descriptor{}, fmt.Errorf("read index '%s' from containerd content store: %w", desc.Digest, err)
+	}
+	var index ocispec.Index
+	if err = json.Unmarshal(blob, &index); err != nil {
+		return ocispec.Descriptor{}, fmt.Errorf("unmarshal index '%s': %w", desc.Digest, err)
+	}
+
+	var changed bool
+	for i, child := range index.Manifests {
+		if _, err = contentStore.Info(ctx, child.Digest); err != nil {
+			if errdefs.IsNotFound(err) {
+				// Partially available multi-platform image.
+				continue
+			}
+			return ocispec.Descriptor{}, fmt.Errorf(
+				"get info for manifest '%s' from containerd content store: %w", child.Digest, err,
+			)
+		}
+
+		repaired, err := r.repairDescriptor(ctx, child)
+		if err != nil {
+			return ocispec.Descriptor{}, err
+		}
+		if repaired.Digest != child.Digest {
+			index.Manifests[i].Digest = repaired.Digest
+			index.Manifests[i].Size = repaired.Size
+			changed = true
+		}
+	}
+	if !changed {
+		return desc, nil
+	}
+
+	return r.rewriteJSON(ctx, desc, blob, map[string]any{"manifests": index.Manifests})
+}
+
+func (r *layerRegenerator) repairManifest(ctx context.Context, desc ocispec.Descriptor) (ocispec.Descriptor, error) {
+	contentStore := r.client.ContentStore()
+	blob, err := content.ReadBlob(ctx, contentStore, desc)
+	if err != nil {
+		return ocispec.Descriptor{}, fmt.Errorf(
+			"read manifest '%s' from containerd content store: %w", desc.Digest, err,
+		)
+	}
+	var manifest ocispec.Manifest
+	if err = json.Unmarshal(blob, &manifest); err != nil {
+		return ocispec.Descriptor{}, fmt.Errorf("unmarshal manifest '%s': %w", desc.Digest, err)
+	}
+
+	// Map the indexes of manifest layers to the indexes of diff IDs in the config skipping non-layer blobs.
+	var missing []int
+	layerIndexes := make(map[int]int)
+	for i, layer := range manifest.Layers {
+		if !images.IsLayerType(layer.MediaType) {
+			continue
+		}
+		layerIndexes[i] = len(layerIndexes)
+		if _, err = contentStore.Info(ctx, layer.Digest); err != nil {
+			if !errdefs.IsNotFound(err) {
+				return ocispec.Descriptor{}, fmt.Errorf(
+					"get info for layer '%s' from containerd content store: %w", layer.Digest, err,
+				)
+			}
+			missing = append(missing, i)
+		}
+	}
+	if len(missing) == 0 {
+		return desc, nil
+	}
+
+	configBlob, err := content.ReadBlob(ctx, contentStore, manifest.Config)
+	if err != nil {
+		return ocispec.Descriptor{}, fmt.Errorf(
+			"read config '%s' from containerd content store: %w", manifest.Config.Digest, err,
+		)
+	}
+	var config ocispec.Image
+	if err = json.Unmarshal(configBlob, &config); err != nil {
+		return ocispec.Descriptor{}, fmt.Errorf("unmarshal config '%s': %w", manifest.Config.Digest, err)
+	}
+	if len(config.RootFS.DiffIDs) != len(layerIndexes) {
+		return ocispec.Descriptor{}, fmt.Errorf(
+			"config '%s' doesn't match layers of manifest '%s'", manifest.Config.Digest, desc.Digest,
+		)
+	}
+
+	namespace := requestNamespace(ctx, r.client)
+	// The snapshots are looked up by the chain IDs of the original diff IDs.
+	diffIDs := config.RootFS.DiffIDs
+	newDiffIDs := append([]digest.Digest(nil), diffIDs...)
+	var changed bool
+	for _, i := range missing {
+		layer := manifest.Layers[i]
+		regenerated, diffID, err := r.regenerateLayer(ctx, diffIDs, layerIndexes[i], layer.MediaType)
+		if err != nil {
+			return ocispec.Descriptor{}, fmt.Errorf(
+				"layer '%s' of manifest '%s' was deleted from containerd content store (discard_unpacked_layers) "+
+					"and can't be regenerated from snapshot: %w", layer.Digest, desc.Digest, err,
+			)
+		}
+		if regenerated.Digest == layer.Digest {
+			continue
+		}
+
+		r.setReplacement(namespacedDigest{namespace: namespace, digest: layer.Digest}, regenerated.Digest)
+		manifest.Layers[i].Digest = regenerated.Digest
+		manifest.Layers[i].Size = regenerated.Size
+		newDiffIDs[layerIndexes[i]] = diffID
+		changed = true
+	}
+	if !changed {
+		return desc, nil
+	}
+
+	configDesc := manifest.Config
+	if !slices.Equal(diffIDs, newDiffIDs) {
+		config.RootFS.DiffIDs = newDiffIDs
+		if configDesc, err = r.rewriteJSON(
+			ctx, manifest.Config, configBlob, map[string]any{"rootfs": config.RootFS},
+		); err != nil {
+			return ocispec.Descriptor{}, err
+		}
+	}
+
+	return r.rewriteJSON(ctx, desc, blob, map[string]any{"config": configDesc, "layers": manifest.Layers})
+}
+
+// regenerateLayer recreates the layer with the given index in the diff IDs chain from its unpacked snapshot and
+// stores it in the containerd content store compressed with the media type. It returns the descriptor of the new
+// layer blob and its uncompressed digest.
+func (r *layerRegenerator) regenerateLayer(
+	ctx context.Context, diffIDs []digest.Digest, index int, mediaType string,
+) (ocispec.Descriptor, digest.Digest, error) {
+	chainID := identity.ChainID(diffIDs[:index+1]).String()
+	log := r.log.WithFields(
+		logrus.Fields{
+			"chainid":     chainID,
+			"snapshotter": r.snapshotter,
+		},
+	)
+
+	// The diff service only supports OCI media types so use the OCI equivalent of Docker layer media types.
+	compression, err := images.DiffCompression(ctx, mediaType)
+	if err != nil {
+		return ocispec.Descriptor{}, "", fmt.Errorf(
+			"determine compression of layer media type '%s': %w", mediaType, err,
+		)
+	}
+	diffMediaType := ocispec.MediaTypeImageLayer
+	switch compression {
+	case "gzip":
+		diffMediaType = ocispec.MediaTypeImageLayerGzip
+	case "zstd":
+		diffMediaType = ocispec.MediaTypeImageLayerZstd
+	}
+
+	log.Debug("Regenerating layer from snapshot.")
+	sn := r.client.SnapshotService(r.snapshotter)
+	desc, err := rootfs.CreateDiff(
+		ctx, chainID, sn, r.client.DiffService(),
+		diff.WithMediaType(diffMediaType),
+		diff.WithLabels(map[string]string{mediaTypeLabel: mediaType}),
+	)
+	if err != nil {
+		return ocispec.Descriptor{}, "", fmt.Errorf("create diff for snapshot '%s': %w", chainID, err)
+	}
+
+	diffID := desc.Digest
+	info, err := r.client.ContentStore().Info(ctx, desc.Digest)
+	if err != nil {
+		return ocispec.Descriptor{}, "", fmt.Errorf(
+			"get info for regenerated layer '%s' from containerd content store: %w", desc.Digest, err,
+		)
+	}
+	if uncompressed, ok := info.Labels[labels.LabelUncompressed]; ok {
+		if diffID, err = digest.Parse(uncompressed); err != nil {
+			return ocispec.Descriptor{}, "", fmt.Errorf("parse uncompressed digest of regenerated layer: %w", err)
+		}
+	}
+	log.WithFields(
+		logrus.Fields{
+			"digest": desc.Digest,
+			"diffid": diffID,
+		},
+	).Debug("Regenerated layer from snapshot.")
+
+	return desc, diffID, nil
+}
+
+// rewriteJSON replaces the top-level fields of the JSON blob preserving the other fields, stores the result in
+// the containerd content store and returns its descriptor.
+func (r *layerRegenerator) rewriteJSON(
+	ctx context.Context, desc ocispec.Descriptor, blob []byte, fields map[string]any,
+) (ocispec.Descriptor, error) {
+	rewritten, err := rewriteJSONFields(blob, fields)
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+
+	newDesc := ocispec.Descriptor{
+		MediaType:   desc.MediaType,
+		Digest:      digest.FromBytes(rewritten),
+		Size:        int64(len(rewritten)),
+		Platform:    desc.Platform,
+		Annotations: desc.Annotations,
+	}
+	info := content.WithLabels(map[string]string{mediaTypeLabel: desc.MediaType})
+	ref := "rewrite-" + newDesc.Digest.String()
+	err = content.WriteBlob(ctx, r.client.ContentStore(), ref, bytes.NewReader(rewritten), newDesc, info)
+	if err != nil {
+		return ocispec.Descriptor{}, fmt.Errorf(
+			"write rewritten '%s' to containerd content store: %w", desc.Digest, err,
+		)
+	}
+
+	return newDesc, nil
+}
+
+// rewriteJSONFields replaces the top-level fields of the JSON object preserving the values of the other fields as is.
+// The fields of the result are sorted by key as the object is marshalled from a map, so the original field order
+// isn't preserved. It doesn't matter as the result is a new blob with its own digest.
+func rewriteJSONFields(blob []byte, fields map[string]any) ([]byte, error) {
+	var obj map[string]json.RawMessage
+	if err := json.Unmarshal(blob, &obj); err != nil {
+		return nil, fmt.Errorf("unmarshal JSON object: %w", err)
+	}
+	for k, v := range fields {
+		raw, err := json.Marshal(v)
+		if err != nil {
+			return nil, fmt.Errorf("marshal JSON field '%s': %w", k, err)
+		}
+		obj[k] = raw
+	}
+
+	rewritten, err := json.Marshal(obj)
+	if err != nil {
+		return nil, fmt.Errorf("marshal JSON object: %w", err)
+	}
+	return rewritten, nil
+}
+
+// regeneratedLayerError returns a human-readable explanation why the discarded layer can't be served.
+func regeneratedLayerError(dgst, replacement digest.Digest) string {
+	return fmt.Sprintf(
+		"layer '%s' was deleted from containerd content store after unpacking (discard_unpacked_layers) and "+
+			"regenerated from snapshot with a different digest '%s'; pull the image by tag to get the rewritten "+
+			"manifest referencing the regenerated layers", dgst, replacement,
+	)
+}
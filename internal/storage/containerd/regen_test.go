@@ -0,0 +1,94 @@
+package containerd
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/containerd/containerd/v2/pkg/namespaces"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestRewriteJSONFields(t *testing.T) {
+	blob := []byte(`{"schemaVersion":2,"mediaType":"application/vnd.oci.image.manifest.v1+json",` +
+		`"layers":[{"digest":"sha256:old"}],"annotations":{"b":"2","a":"1"}}`)
+
+	rewritten, err := rewriteJSONFields(blob, map[string]any{"layers": []map[string]string{{"digest": "sha256:new"}}})
+	if err != nil {
+		t.Fatalf("rewrite JSON fields: %v", err)
+	}
+	// The fields are sorted by key and the values of the other fields are preserved as is.
+	want := `{"annotations":{"b":"2","a":"1"},"layers":[{"digest":"sha256:new"}],` +
+		`"mediaType":"application/vnd.oci.image.manifest.v1+json","schemaVersion":2}`
+	if string(rewritten) != want {
+		t.Errorf("expected %s, got %s", want, rewritten)
+	}
+
+	if _, err = rewriteJSONFields([]byte(`[]`), nil); err == nil {
+		t.Error("expected error for non-object JSON")
+	}
+}
+
+func TestLayerRegeneratorReplacement(t *testing.T) {
+	r, err := newLayerRegenerator(nil, "overlayfs")
+	if err != nil {
+		t.Fatalf("create layer regenerator: %v", err)
+	}
+	original := digest.FromString("original")
+	regenerated := digest.FromString("regenerated")
+	ctx := namespaces.WithNamespace(context.Background(), "default")
+	otherCtx := namespaces.WithNamespace(context.Background(), "other")
+
+	r.setReplacement(namespacedDigest{namespace: "default", digest: original}, regenerated)
+	if replacement, ok := r.replacement(ctx, original); !ok || replacement != regenerated {
+		t.Errorf("expected replacement %s, got %s (found: %t)", regenerated, replacement, ok)
+	}
+	if _, ok := r.replacement(otherCtx, original); ok {
+		t.Error("replacement must not be found in another namespace")
+	}
+
+	// Expired replacements aren't returned and are pruned when new ones are added.
+	r.replaced[namespacedDigest{namespace: "default", digest: original}] = replacedLayer{
+		digest:  regenerated,
+		created: time.Now().Add(-leaseExpiration),
+	}
+	if _, ok := r.replacement(ctx, original); ok {
+		t.Error("expired replacement must not be found")
+	}
+	r.setReplacement(namespacedDigest{namespace: "other", digest: original}, regenerated)
+	if len(r.replaced) != 1 {
+		t.Errorf("expected expired replacement to be pruned, got %d replacements", len(r.replaced))
+	}
+}
+
+func TestLayerRegeneratorCachedRewrite(t *testing.T) {
+	r, err := newLayerRegenerator(nil, "overlayfs")
+	if err != nil {
+		t.Fatalf("create layer regenerator: %v", err)
+	}
+	key := namespacedDigest{namespace: "default", digest: digest.FromString("manifest")}
+	rewritten := ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageManifest,
+		Digest:    digest.FromString("rewritten"),
+		Size:      9,
+	}
+
+	if _, ok := r.cachedRewrite(key); ok {
+		t.Fatal("unexpected cached rewrite")
+	}
+	r.setRewrite(key, rewritten)
+	if desc, ok := r.cachedRewrite(key); !ok || desc.Digest != rewritten.Digest {
+		t.Errorf("expected cached rewrite %s, got %s (found: %t)", rewritten.Digest, desc.Digest, ok)
+	}
+
+	r.rewritten[key] = rewrittenDescriptor{desc: rewritten, created: time.Now().Add(-leaseExpiration)}
+	if _, ok := r.cachedRewrite(key); ok {
+		t.Error("expired rewrite must not be found")
+	}
+	otherKey := namespacedDigest{namespace: "default", digest: digest.FromString("other")}
+	r.setRewrite(otherKey, rewritten)
+	if _, ok := r.rewritten[key]; ok {
+		t.Error("expected expired rewrite to be pruned")
+	}
+}
@@ -2,6 +2,10 @@ package containerd
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
 
 	"github.com/containerd/containerd/v2/client"
 	"github.com/distribution/distribution/v3"
@@ -12,6 +16,37 @@ import (
 // registry implements distribution.Namespace backed by containerd image store.
 type registry struct {
 	client *client.Client
+	// gcOnDelete enables synchronous containerd garbage collection when images are deleted through the registry API.
+	gcOnDelete bool
+	// uploadLeases keeps track of containerd leases created by blob writers to upload content. It's shared between
+	// all repositories.
+	uploadLeases *uploadLeases
+	// contentRoot is the optional path to the root directory of the containerd content store on the local disk used
+	// to serve blobs directly from the files.
+	contentRoot string
+	// unpacker unpacks tagged images into a containerd snapshotter. Nil if unpacking is disabled.
+	unpacker *unpacker
+	// unpackPipeline applies pushed layers into a containerd snapshotter while the push is still uploading.
+	// Nil if the pipeline is disabled.
+	unpackPipeline *unpackPipeline
+	// dockerLoader loads tagged images into the classic Docker image store. Nil if loading is disabled.
+	dockerLoader *dockerLoader
+	// dockerSource imports images missing in containerd from the classic Docker image store. Nil if disabled.
+	dockerSource *dockerSource
+	// regenerator recreates layers deleted from the containerd content store after unpacking from the snapshots.
+	// Nil if regeneration is disabled.
+	regenerator *layerRegenerator
+	// siblingNamespaces are the containerd namespaces to reuse blobs from that are missing in the request namespace.
+	siblingNamespaces []string
+	// peers fetches images and blobs missing in containerd from other unregistry instances. Nil if no peers are
+	// configured.
+	peers *peers
+	// upstream pulls images and blobs missing in containerd through from the upstream registry. Nil if disabled.
+	upstream *upstream
+	// replicator pushes tagged images to other unregistry instances. Nil if replication is disabled.
+	replicator *Replicator
+	// nameMappings rewrite the repository names in requests to the containerd image names.
+	nameMappings []nameMapping
 }
 
 // Ensure registry implements distribution.registry.
@@ -24,12 +59,43 @@ func (r *registry) Scope() distribution.Scope {
 
 // Repository returns an instance of repository for the given name.
 func (r *registry) Repository(_ context.Context, name reference.Named) (distribution.Repository, error) {
-	return newRepository(r.client, name), nil
+	return newRepository(r, name), nil
 }
 
-// Repositories should return a list of repositories in the registry but it's not supported for simplicity.
-func (r *registry) Repositories(_ context.Context, _ []string, _ string) (int, error) {
-	return 0, distribution.ErrUnsupported
+// Repositories fills repos with a lexically sorted catalog of repositories in the registry, starting after last.
+// The repositories are derived from the names of tagged images in the containerd image store. The names are returned
+// in the familiar form, e.g. "ubuntu" for "docker.io/library/ubuntu", so that they can be used in the registry API.
+// It returns io.EOF when there are no more repositories after the ones filled in repos.
+func (r *registry) Repositories(ctx context.Context, repos []string, last string) (int, error) {
+	if len(repos) == 0 {
+		return 0, errors.New("attempted to list 0 repositories")
+	}
+
+	imgs, err := r.client.ImageService().List(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("list images in containerd image store: %w", err)
+	}
+
+	var names []string
+	for _, img := range imgs {
+		if ref, ok := parseTaggedImageName(img.Name); ok {
+			names = append(names, reference.FamiliarName(ref))
+		}
+	}
+	slices.Sort(names)
+	names = slices.Compact(names)
+
+	// Skip the repositories up to and including last.
+	start, found := slices.BinarySearch(names, last)
+	if found {
+		start++
+	}
+	n := copy(repos, names[start:])
+	if start+n == len(names) {
+		return n, io.EOF
+	}
+
+	return n, nil
 }
 
 // Blobs returns a stub implementation of distribution.BlobEnumerator that doesn't support enumeration.
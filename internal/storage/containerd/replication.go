@@ -0,0 +1,462 @@
+package containerd
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/containerd/containerd/v2/client"
+	"github.com/containerd/containerd/v2/core/content"
+	"github.com/containerd/containerd/v2/core/images"
+	"github.com/containerd/containerd/v2/pkg/namespaces"
+	"github.com/containerd/errdefs"
+	"github.com/distribution/reference"
+	"github.com/google/uuid"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// ReplicationStatusPath is the path of the endpoint that reports the replication status of each target.
+	ReplicationStatusPath = "/replication/status"
+	// replicationMinBackoff is the delay before the first retry of a failed replication.
+	replicationMinBackoff = 5 * time.Second
+	// replicationMaxBackoff is the maximum delay between retries of a failed replication.
+	replicationMaxBackoff = 10 * time.Minute
+	// replicationPushTimeout is the maximum time to push an image to a target before the attempt is retried.
+	replicationPushTimeout = 30 * time.Minute
+)
+
+// Replicator pushes tagged images to other unregistry instances (replication targets) in the background so that
+// an image pushed to one node reaches the others. Only the content missing in a target is pushed. Pending replications
+// are persisted in a JSON file so that they survive restarts and are retried with exponential backoff until they
+// succeed. If an image is tagged again before it's replicated, only the latest version is replicated. Replications of
+// images that have been deleted or retagged without replication in the meantime are dropped.
+type Replicator struct {
+	client       *client.Client
+	contentStore content.Store
+	imageStore   images.Store
+	// targets are the URLs of the unregistry instances to replicate images to, e.g. "http://node2:5000".
+	targets []string
+	// path is the path to the file the replication state is persisted in.
+	path string
+	// username and password are the optional credentials to authenticate to the targets that require authentication.
+	username string
+	password string
+	log      *logrus.Entry
+
+	mu    sync.Mutex
+	state replicationState
+	// wake signals the target workers that a new task is queued.
+	wake map[string]chan struct{}
+}
+
+// replicationState is the persisted state of the replication queue.
+type replicationState struct {
+	// Tasks are the pending replications of all targets.
+	Tasks []*replicationTask `json:"tasks"`
+	// Targets is the status of the last replication attempt of each target.
+	Targets map[string]*replicationTargetStatus `json:"targets"`
+}
+
+// replicationTask is a pending replication of an image to a target.
+type replicationTask struct {
+	ID          string             `json:"id"`
+	TargetURL   string             `json:"targetURL"`
+	Namespace   string             `json:"namespace"`
+	Image       string             `json:"image"`
+	Descriptor  ocispec.Descriptor `json:"descriptor"`
+	EnqueuedAt  time.Time          `json:"enqueuedAt"`
+	Attempts    int                `json:"attempts"`
+	NextAttempt time.Time          `json:"nextAttempt"`
+	LastError   string             `json:"lastError,omitempty"`
+}
+
+// replicationTargetStatus is the status of the last replication attempt of a target.
+type replicationTargetStatus struct {
+	LastReplicated time.Time `json:"lastReplicated,omitzero"`
+	LastError      string    `json:"lastError,omitempty"`
+	LastErrorAt    time.Time `json:"lastErrorAt,omitzero"`
+}
+
+// NewReplicator creates a Replicator that replicates images to the targets and persists the pending replications in
+// the file at path. The credentials to authenticate to the targets are optional. Pending replications to targets that
+// are no longer configured are dropped.
+func NewReplicator(client *client.Client, targets []string, path, username, password string) (*Replicator, error) {
+	if path == "" {
+		return nil, fmt.Errorf("replication queue path is required")
+	}
+	for _, target := range targets {
+		if _, err := newUpstream(client, target, "", "", nil); err != nil {
+			return nil, fmt.Errorf("invalid replication target: %w", err)
+		}
+	}
+
+	r := &Replicator{
+		client:   client,
+		targets:  targets,
+		path:     path,
+		username: username,
+		password: password,
+		log:      logrus.WithField("component", "replicator"),
+		wake:     make(map[string]chan struct{}),
+	}
+	if client != nil {
+		r.contentStore = client.ContentStore()
+		r.imageStore = client.ImageService()
+	}
+	for _, target := range targets {
+		r.wake[target] = make(chan struct{}, 1)
+	}
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// load reads the persisted replication state from the file if it exists.
+func (r *Replicator) load() error {
+	r.state = replicationState{Targets: make(map[string]*replicationTargetStatus)}
+	data, err := os.ReadFile(r.path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return fmt.Errorf("read replication queue '%s': %w", r.path, err)
+	}
+	if err = json.Unmarshal(data, &r.state); err != nil {
+		return fmt.Errorf("parse replication queue '%s': %w", r.path, err)
+	}
+	if r.state.Targets == nil {
+		r.state.Targets = make(map[string]*replicationTargetStatus)
+	}
+
+	r.state.Tasks = slices.DeleteFunc(r.state.Tasks, func(task *replicationTask) bool {
+		return !slices.Contains(r.targets, task.TargetURL)
+	})
+	if len(r.state.Tasks) > 0 {
+		r.log.WithField("tasks", len(r.state.Tasks)).Info("Resuming pending image replications.")
+	}
+	return nil
+}
+
+// save persists the replication state to the file. The file is replaced atomically so that it isn't corrupted if
+// unregistry is killed while writing it. Must be called with the mutex held.
+func (r *Replicator) save() error {
+	data, err := json.Marshal(r.state)
+	if err != nil {
+		return fmt.Errorf("marshal replication queue: %w", err)
+	}
+	if err = os.MkdirAll(filepath.Dir(r.path), 0o755); err != nil {
+		return fmt.Errorf("create directory for replication queue: %w", err)
+	}
+	tmp := r.path + ".tmp"
+	if err = os.WriteFile(tmp, data, 0o644); err != nil {
+		return fmt.Errorf("write replication queue '%s': %w", tmp, err)
+	}
+	if err = os.Rename(tmp, r.path); err != nil {
+		return fmt.Errorf("replace replication queue '%s': %w", r.path, err)
+	}
+	return nil
+}
+
+// enqueue queues the replication of the image in the request namespace to all targets replacing the pending
+// replications of the previous versions of the image. Failures to persist the queue are only logged as the image
+// is still replicated unless unregistry is restarted.
+func (r *Replicator) enqueue(ctx context.Context, img string, desc ocispec.Descriptor) {
+	namespace := requestNamespace(ctx, r.client)
+	now := time.Now()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.state.Tasks = slices.DeleteFunc(r.state.Tasks, func(task *replicationTask) bool {
+		return task.Namespace == namespace && task.Image == img
+	})
+	for _, target := range r.targets {
+		r.state.Tasks = append(r.state.Tasks, &replicationTask{
+			ID:          uuid.NewString(),
+			TargetURL:   target,
+			Namespace:   namespace,
+			Image:       img,
+			Descriptor:  desc,
+			EnqueuedAt:  now,
+			NextAttempt: now,
+		})
+	}
+	if err := r.save(); err != nil {
+		r.log.WithError(err).Warn("Failed to persist replication queue.")
+	}
+	for _, wake := range r.wake {
+		select {
+		case wake <- struct{}{}:
+		default:
+		}
+	}
+
+	r.log.WithFields(
+		logrus.Fields{
+			"image":     img,
+			"namespace": namespace,
+			"targets":   len(r.targets),
+		},
+	).Debug("Queued image replication.")
+}
+
+// Run replicates the queued images to each target until the context is canceled.
+func (r *Replicator) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, target := range r.targets {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r.runTarget(ctx, target)
+		}()
+	}
+	wg.Wait()
+}
+
+// runTarget replicates the queued images to the target one at a time in the order they're due.
+func (r *Replicator) runTarget(ctx context.Context, target string) {
+	for {
+		task, wait := r.next(target)
+		if task != nil {
+			r.replicate(ctx, task)
+			continue
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-r.wake[target]:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+}
+
+// next returns a copy of the next task of the target that is due or the time to wait until the next task is due.
+func (r *Replicator) next(target string) (*replicationTask, time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var next *replicationTask
+	for _, task := range r.state.Tasks {
+		if task.TargetURL == target && (next == nil || task.NextAttempt.Before(next.NextAttempt)) {
+			next = task
+		}
+	}
+	if next == nil {
+		return nil, replicationMaxBackoff
+	}
+	if wait := time.Until(next.NextAttempt); wait > 0 {
+		return nil, wait
+	}
+	task := *next
+	return &task, 0
+}
+
+// replicate pushes the image of the task to its target and removes the task from the queue if it succeeds,
+// otherwise schedules a retry with exponential backoff. The task is dropped if the image no longer exists or has been
+// retagged as its content may no longer exist. It's also dropped with the error reported in the target status if
+// the image content is missing locally, e.g. layers of other platforms that were never fetched from the upstream or
+// peers or were discarded after unpacking, as retries can't push it either.
+func (r *Replicator) replicate(ctx context.Context, task *replicationTask) {
+	log := r.log.WithFields(
+		logrus.Fields{
+			"image":     task.Image,
+			"namespace": task.Namespace,
+			"target":    task.TargetURL,
+		},
+	)
+	ctx = namespaces.WithNamespace(ctx, task.Namespace)
+	img, err := r.imageStore.Get(ctx, task.Image)
+	if err == nil && img.Target.Digest != task.Descriptor.Digest {
+		err = errdefs.ErrNotFound
+	}
+	if errdefs.IsNotFound(err) {
+		log.Info("Dropped replication of image that has been deleted or retagged.")
+		r.drop(task)
+		return
+	}
+	if err == nil {
+		pushCtx, cancel := context.WithTimeout(ctx, replicationPushTimeout)
+		err = r.push(pushCtx, task)
+		cancel()
+	}
+	if ctx.Err() != nil {
+		// Retry the interrupted replication after restart.
+		return
+	}
+	missing := errdefs.IsNotFound(err)
+	if missing {
+		err = fmt.Errorf("image content is missing locally: %w", err)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	status, ok := r.state.Targets[task.TargetURL]
+	if !ok {
+		status = &replicationTargetStatus{}
+		r.state.Targets[task.TargetURL] = status
+	}
+	i := slices.IndexFunc(r.state.Tasks, func(t *replicationTask) bool {
+		return t.ID == task.ID
+	})
+
+	if err != nil {
+		status.LastError = err.Error()
+		status.LastErrorAt = time.Now()
+		// The task could have been replaced by a newer version of the image in the meantime.
+		if i >= 0 && missing {
+			r.state.Tasks = slices.Delete(r.state.Tasks, i, i+1)
+			log = log.WithField("dropped", true)
+		} else if i >= 0 {
+			queued := r.state.Tasks[i]
+			queued.Attempts++
+			queued.LastError = err.Error()
+			queued.NextAttempt = time.Now().Add(replicationBackoff(queued.Attempts))
+			log = log.WithFields(
+				logrus.Fields{
+					"attempts": queued.Attempts,
+					"retry_in": time.Until(queued.NextAttempt).Round(time.Second),
+				},
+			)
+		}
+		log.WithError(err).Warn("Failed to replicate image.")
+	} else {
+		status.LastReplicated = time.Now()
+		status.LastError = ""
+		status.LastErrorAt = time.Time{}
+		if i >= 0 {
+			r.state.Tasks = slices.Delete(r.state.Tasks, i, i+1)
+		}
+		log.WithField("lag", time.Since(task.EnqueuedAt).Round(time.Millisecond)).Info("Replicated image.")
+	}
+
+	if err = r.save(); err != nil {
+		r.log.WithError(err).Warn("Failed to persist replication queue.")
+	}
+}
+
+// drop removes the task from the queue.
+func (r *Replicator) drop(task *replicationTask) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.state.Tasks = slices.DeleteFunc(r.state.Tasks, func(t *replicationTask) bool {
+		return t.ID == task.ID
+	})
+	if err := r.save(); err != nil {
+		r.log.WithError(err).Warn("Failed to persist replication queue.")
+	}
+}
+
+// push pushes the image of the task to its target. The target is asked to store the image in the same namespace and
+// to not replicate it further so that targets replicating to each other don't push the image back and forth.
+func (r *Replicator) push(ctx context.Context, task *replicationTask) error {
+	ref, err := reference.ParseNormalizedNamed(task.Image)
+	if err != nil {
+		return fmt.Errorf("parse image name '%s': %w", task.Image, err)
+	}
+	tagged, ok := ref.(reference.NamedTagged)
+	if !ok {
+		return fmt.Errorf("image name '%s' has no tag", task.Image)
+	}
+
+	// The image is pushed to the repository path without the domain which may not be valid in the target, e.g.
+	// "localhost:5000/myapp", so the full repository name is sent in the RepositoryHeader to store it under.
+	headers := http.Header{
+		PeerHeader:       []string{"true"},
+		NamespaceHeader:  []string{task.Namespace},
+		RepositoryHeader: []string{tagged.Name()},
+	}
+	target, err := newUpstream(r.client, task.TargetURL, r.username, r.password, headers)
+	if err != nil {
+		return err
+	}
+	return target.push(ctx, tagged, task.Descriptor, r.contentStore)
+}
+
+// replicationBackoff returns the delay before the retry after the given number of failed attempts.
+func replicationBackoff(attempts int) time.Duration {
+	backoff := replicationMinBackoff
+	for i := 1; i < attempts && backoff < replicationMaxBackoff; i++ {
+		backoff *= 2
+	}
+	return min(backoff, replicationMaxBackoff)
+}
+
+// replicationTargetReport is the replication status of a target reported by the status endpoint.
+type replicationTargetReport struct {
+	Target string `json:"target"`
+	// Pending is the number of images waiting to be replicated to the target.
+	Pending int `json:"pending"`
+	// LagSeconds is the time since the oldest pending image was queued, 0 if the target is up to date.
+	LagSeconds     float64   `json:"lagSeconds"`
+	LastReplicated time.Time `json:"lastReplicated,omitzero"`
+	LastError      string    `json:"lastError,omitempty"`
+	LastErrorAt    time.Time `json:"lastErrorAt,omitzero"`
+}
+
+// status returns the replication status of each target.
+func (r *Replicator) status() []replicationTargetReport {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	reports := make([]replicationTargetReport, 0, len(r.targets))
+	for _, target := range r.targets {
+		report := replicationTargetReport{Target: target}
+		if status, ok := r.state.Targets[target]; ok {
+			report.LastReplicated = status.LastReplicated
+			report.LastError = status.LastError
+			report.LastErrorAt = status.LastErrorAt
+		}
+		for _, task := range r.state.Tasks {
+			if task.TargetURL != target {
+				continue
+			}
+			report.Pending++
+			report.LagSeconds = max(report.LagSeconds, time.Since(task.EnqueuedAt).Seconds())
+		}
+		reports = append(reports, report)
+	}
+	return reports
+}
+
+// NewReplicationStatusHandler returns an http.Handler that serves the replication status of each target as JSON at
+// ReplicationStatusPath and passes other requests to the next handler.
+func NewReplicationStatusHandler(replicator *Replicator, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != ReplicationStatusPath {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if r.Method == http.MethodHead {
+			return
+		}
+		if err := json.NewEncoder(w).Encode(struct {
+			Targets []replicationTargetReport `json:"targets"`
+		}{Targets: replicator.status()}); err != nil {
+			logrus.WithError(err).Debug("Failed to write replication status response.")
+		}
+	})
+}
@@ -0,0 +1,294 @@
+package containerd
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/containerd/containerd/v2/core/images"
+	"github.com/containerd/containerd/v2/pkg/namespaces"
+	"github.com/containerd/containerd/v2/plugins/content/local"
+	"github.com/containerd/errdefs"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// fakeImageStore is an in-memory images.Store that ignores namespaces and list filters.
+type fakeImageStore struct {
+	mu     sync.Mutex
+	images map[string]images.Image
+}
+
+func newFakeImageStore(imgs ...images.Image) *fakeImageStore {
+	s := &fakeImageStore{images: make(map[string]images.Image)}
+	for _, img := range imgs {
+		s.images[img.Name] = img
+	}
+	return s
+}
+
+func (s *fakeImageStore) Get(_ context.Context, name string) (images.Image, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	img, ok := s.images[name]
+	if !ok {
+		return images.Image{}, errdefs.ErrNotFound
+	}
+	return img, nil
+}
+
+func (s *fakeImageStore) List(_ context.Context, _ ...string) ([]images.Image, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	imgs := make([]images.Image, 0, len(s.images))
+	for _, img := range s.images {
+		imgs = append(imgs, img)
+	}
+	return imgs, nil
+}
+
+func (s *fakeImageStore) Create(_ context.Context, img images.Image) (images.Image, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.images[img.Name]; ok {
+		return images.Image{}, errdefs.ErrAlreadyExists
+	}
+	s.images[img.Name] = img
+	return img, nil
+}
+
+func (s *fakeImageStore) Update(_ context.Context, img images.Image, _ ...string) (images.Image, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.images[img.Name]; !ok {
+		return images.Image{}, errdefs.ErrNotFound
+	}
+	s.images[img.Name] = img
+	return img, nil
+}
+
+func (s *fakeImageStore) Delete(_ context.Context, name string, _ ...images.DeleteOpt) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.images[name]; !ok {
+		return errdefs.ErrNotFound
+	}
+	delete(s.images, name)
+	return nil
+}
+
+func TestReplicatorQueuePersisted(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "replication.json")
+	targets := []string{"http://node2:5000", "http://node3:5000"}
+	r, err := NewReplicator(nil, targets, path, "", "")
+	if err != nil {
+		t.Fatalf("create replicator: %v", err)
+	}
+
+	ctx := namespaces.WithNamespace(context.Background(), "moby")
+	v1 := ocispec.Descriptor{MediaType: ocispec.MediaTypeImageManifest, Digest: digest.FromString("v1"), Size: 2}
+	v2 := ocispec.Descriptor{MediaType: ocispec.MediaTypeImageManifest, Digest: digest.FromString("v2"), Size: 2}
+	r.enqueue(ctx, "docker.io/library/myapp:latest", v1)
+	// Tagging the image again replaces the pending replications of the previous version.
+	r.enqueue(ctx, "docker.io/library/myapp:latest", v2)
+
+	// Restart with one of the targets removed.
+	r, err = NewReplicator(nil, targets[:1], path, "", "")
+	if err != nil {
+		t.Fatalf("create replicator: %v", err)
+	}
+	if len(r.state.Tasks) != 1 {
+		t.Fatalf("expected 1 pending task, got %d", len(r.state.Tasks))
+	}
+	task := r.state.Tasks[0]
+	if task.TargetURL != targets[0] || task.Namespace != "moby" || task.Descriptor.Digest != v2.Digest {
+		t.Errorf("unexpected task %+v", task)
+	}
+
+	next, _ := r.next(targets[0])
+	if next == nil || next.ID != task.ID {
+		t.Fatalf("expected task %s to be due, got %+v", task.ID, next)
+	}
+}
+
+func TestReplicatorReplicate(t *testing.T) {
+	ctx := namespaces.WithNamespace(context.Background(), "moby")
+	cs, err := local.NewStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("create content store: %v", err)
+	}
+	img, _, _ := writeTestImage(t, ctx, cs)
+	// The domain with a port isn't valid in the repository path of the target.
+	img.Name = "localhost:5000/myapp:latest"
+
+	registry := newTestRegistry(t)
+	var repositories []string
+	var mu sync.Mutex
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		repositories = append(repositories, r.Header.Get(RepositoryHeader))
+		mu.Unlock()
+		registry.Config.Handler.ServeHTTP(w, r)
+	}))
+	t.Cleanup(target.Close)
+
+	r, err := NewReplicator(nil, []string{target.URL}, filepath.Join(t.TempDir(), "replication.json"), "", "")
+	if err != nil {
+		t.Fatalf("create replicator: %v", err)
+	}
+	r.contentStore = cs
+	r.imageStore = newFakeImageStore(img)
+
+	t.Run("push image", func(t *testing.T) {
+		r.enqueue(ctx, img.Name, img.Target)
+		task, _ := r.next(target.URL)
+		if task == nil {
+			t.Fatal("expected task to be due")
+		}
+		r.replicate(ctx, task)
+
+		if len(r.state.Tasks) != 0 {
+			t.Fatalf("expected replicated task to be removed, got %d pending tasks", len(r.state.Tasks))
+		}
+		if status := r.state.Targets[target.URL]; status == nil || status.LastError != "" {
+			t.Fatalf("expected successful replication status, got %+v", status)
+		}
+
+		req, err := http.NewRequest(http.MethodHead, registry.URL+"/v2/myapp/manifests/latest", nil)
+		if err != nil {
+			t.Fatalf("create manifest request: %v", err)
+		}
+		req.Header.Set("Accept", ocispec.MediaTypeImageManifest)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("get manifest: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("expected pushed manifest in target, got status %d", resp.StatusCode)
+		}
+		if got := resp.Header.Get("Docker-Content-Digest"); got != img.Target.Digest.String() {
+			t.Errorf("expected manifest digest %s, got %s", img.Target.Digest, got)
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		for _, repo := range repositories {
+			if repo != "localhost:5000/myapp" {
+				t.Errorf("expected %s header %q, got %q", RepositoryHeader, "localhost:5000/myapp", repo)
+			}
+		}
+	})
+
+	t.Run("drop deleted image", func(t *testing.T) {
+		r.enqueue(ctx, "localhost:5000/deleted:latest", img.Target)
+		task, _ := r.next(target.URL)
+		if task == nil {
+			t.Fatal("expected task to be due")
+		}
+		r.replicate(ctx, task)
+
+		if len(r.state.Tasks) != 0 {
+			t.Errorf("expected task of deleted image to be dropped, got %d pending tasks", len(r.state.Tasks))
+		}
+	})
+
+	t.Run("drop image with content missing locally", func(t *testing.T) {
+		missing := images.Image{
+			Name: "localhost:5000/missing:latest",
+			Target: ocispec.Descriptor{
+				MediaType: ocispec.MediaTypeImageManifest,
+				Digest:    digest.FromString("missing"),
+				Size:      7,
+			},
+		}
+		if _, err := r.imageStore.Create(ctx, missing); err != nil {
+			t.Fatalf("create image: %v", err)
+		}
+		r.enqueue(ctx, missing.Name, missing.Target)
+		task, _ := r.next(target.URL)
+		if task == nil {
+			t.Fatal("expected task to be due")
+		}
+		r.replicate(ctx, task)
+
+		if len(r.state.Tasks) != 0 {
+			t.Errorf("expected task of image with missing content to be dropped, got %d pending tasks",
+				len(r.state.Tasks))
+		}
+		if status := r.state.Targets[target.URL]; status == nil || status.LastError == "" {
+			t.Errorf("expected missing content error in replication status, got %+v", status)
+		}
+	})
+
+	t.Run("drop retagged image", func(t *testing.T) {
+		r.enqueue(ctx, img.Name, ocispec.Descriptor{
+			MediaType: ocispec.MediaTypeImageManifest,
+			Digest:    digest.FromString("previous"),
+			Size:      8,
+		})
+		task, _ := r.next(target.URL)
+		if task == nil {
+			t.Fatal("expected task to be due")
+		}
+		r.replicate(ctx, task)
+
+		if len(r.state.Tasks) != 0 {
+			t.Errorf("expected task of retagged image to be dropped, got %d pending tasks", len(r.state.Tasks))
+		}
+	})
+}
+
+func TestReplicationBackoff(t *testing.T) {
+	tests := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{attempts: 1, want: replicationMinBackoff},
+		{attempts: 2, want: 2 * replicationMinBackoff},
+		{attempts: 3, want: 4 * replicationMinBackoff},
+		{attempts: 100, want: replicationMaxBackoff},
+	}
+	for _, tt := range tests {
+		if got := replicationBackoff(tt.attempts); got != tt.want {
+			t.Errorf("expected backoff %s after %d attempts, got %s", tt.want, tt.attempts, got)
+		}
+	}
+}
+
+func TestReplicationStatusHandler(t *testing.T) {
+	r, err := NewReplicator(nil, []string{"http://node2:5000"}, filepath.Join(t.TempDir(), "replication.json"), "", "")
+	if err != nil {
+		t.Fatalf("create replicator: %v", err)
+	}
+	ctx := namespaces.WithNamespace(context.Background(), "moby")
+	r.enqueue(ctx, "docker.io/library/myapp:latest", ocispec.Descriptor{Digest: digest.FromString("v1")})
+
+	handler := NewReplicationStatusHandler(r, http.NotFoundHandler())
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, ReplicationStatusPath, nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, rec.Code)
+	}
+
+	var resp struct {
+		Targets []replicationTargetReport `json:"targets"`
+	}
+	if err = json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("unmarshal response: %v", err)
+	}
+	if len(resp.Targets) != 1 || resp.Targets[0].Target != "http://node2:5000" || resp.Targets[0].Pending != 1 {
+		t.Errorf("unexpected status %+v", resp.Targets)
+	}
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/v2/", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("expected other requests to be passed to the next handler, got status %d", rec.Code)
+	}
+}
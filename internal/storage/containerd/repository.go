@@ -10,21 +10,50 @@ import (
 
 // repository implements distribution.Repository backed by the containerd content and image stores.
 type repository struct {
-	client    *client.Client
-	name      reference.Named
-	blobStore *blobStore
+	client       *client.Client
+	name         reference.Named
+	blobStore    *blobStore
+	gcOnDelete   bool
+	uploadLeases *uploadLeases
+	unpacker     *unpacker
+	dockerLoader *dockerLoader
+	dockerSource *dockerSource
+	peers        *peers
+	upstream     *upstream
+	replicator   *Replicator
+	regenerator  *layerRegenerator
+	nameMappings []nameMapping
 }
 
 var _ distribution.Repository = &repository{}
 
-func newRepository(client *client.Client, name reference.Named) *repository {
+func newRepository(reg *registry, name reference.Named) *repository {
 	return &repository{
-		client: client,
+		client: reg.client,
 		name:   name,
 		blobStore: &blobStore{
-			client: client,
-			repo:   name,
+			client:            reg.client,
+			repo:              name,
+			uploadLeases:      reg.uploadLeases,
+			contentRoot:       reg.contentRoot,
+			unpackPipeline:    reg.unpackPipeline,
+			regenerator:       reg.regenerator,
+			siblingNamespaces: reg.siblingNamespaces,
+			peers:             reg.peers,
+			upstream:          reg.upstream,
+			dockerSource:      reg.dockerSource,
+			nameMappings:      reg.nameMappings,
 		},
+		gcOnDelete:   reg.gcOnDelete,
+		uploadLeases: reg.uploadLeases,
+		unpacker:     reg.unpacker,
+		dockerLoader: reg.dockerLoader,
+		dockerSource: reg.dockerSource,
+		peers:        reg.peers,
+		upstream:     reg.upstream,
+		replicator:   reg.replicator,
+		regenerator:  reg.regenerator,
+		nameMappings: reg.nameMappings,
 	}
 }
 
@@ -35,11 +64,12 @@ func (r *repository) Named() reference.Named {
 
 // Manifests returns the manifest service for the repository backed by the containerd content store.
 func (r *repository) Manifests(
-	_ context.Context, _ ...distribution.ManifestServiceOption,
+	ctx context.Context, _ ...distribution.ManifestServiceOption,
 ) (distribution.ManifestService, error) {
 	return &manifestService{
-		repo:      r.name,
-		blobStore: r.blobStore,
+		repo:       r.name,
+		blobStore:  r.blobStore,
+		tagService: r.newTagService(ctx),
 	}, nil
 }
 
@@ -48,12 +78,25 @@ func (r *repository) Blobs(_ context.Context) distribution.BlobStore {
 	return r.blobStore
 }
 
-// Tags returns the tag service for the repository backed by the containerd image store.
-func (r *repository) Tags(_ context.Context) distribution.TagService {
-	// Shouldn't return an error as r.name is a valid reference.
-	canonicalRepo, _ := reference.ParseNormalizedNamed(r.name.String())
+// Tags returns the tag service for the repository backed by the containerd image store. The tags are resolved in
+// the repository name set by the client, rewritten by the name mapping rules, or in the mirrored registry if
+// the request is sent by containerd to a registry mirror.
+func (r *repository) Tags(ctx context.Context) distribution.TagService {
+	return r.newTagService(ctx)
+}
+
+func (r *repository) newTagService(ctx context.Context) *tagService {
 	return &tagService{
 		client:        r.client,
-		canonicalRepo: canonicalRepo,
+		canonicalRepo: canonicalRepository(ctx, r.name, r.nameMappings),
+		gcOnDelete:    r.gcOnDelete,
+		uploadLeases:  r.uploadLeases,
+		unpacker:      r.unpacker,
+		dockerLoader:  r.dockerLoader,
+		dockerSource:  r.dockerSource,
+		peers:         r.peers,
+		upstream:      r.upstream,
+		replicator:    r.replicator,
+		regenerator:   r.regenerator,
 	}
 }
@@ -0,0 +1,45 @@
+package containerd
+
+import (
+	"context"
+	"io"
+	"net/http"
+)
+
+// rawResponseWriterKey is the request context key for the original http.ResponseWriter of the HTTP server.
+type rawResponseWriterKey struct{}
+
+// NewSendfileHandler returns an http.Handler that stores the original response writer of the HTTP server in
+// the request context before passing the request to next. The distribution registry wraps the response writer
+// for instrumentation which hides its io.ReaderFrom implementation, so blobs served from files on the local disk
+// would be copied through user space instead of using sendfile.
+func NewSendfileHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := context.WithValue(r.Context(), rawResponseWriterKey{}, w)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// sendfileResponseWriter is an http.ResponseWriter that sets the headers and status code through the wrapped
+// response writer and copies the body with the io.ReaderFrom of the original response writer.
+type sendfileResponseWriter struct {
+	http.ResponseWriter
+	rf io.ReaderFrom
+}
+
+// withSendfile returns a response writer that uses the io.ReaderFrom of the original response writer stored
+// in the request context by NewSendfileHandler. If it's not available, w is returned as is.
+func withSendfile(w http.ResponseWriter, r *http.Request) http.ResponseWriter {
+	rf, ok := r.Context().Value(rawResponseWriterKey{}).(io.ReaderFrom)
+	if !ok {
+		return w
+	}
+	return &sendfileResponseWriter{
+		ResponseWriter: w,
+		rf:             rf,
+	}
+}
+
+func (w *sendfileResponseWriter) ReadFrom(r io.Reader) (int64, error) {
+	return w.rf.ReadFrom(r)
+}
@@ -0,0 +1,118 @@
+package containerd
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/containerd/containerd/v2/core/content"
+	"github.com/containerd/containerd/v2/core/leases"
+	"github.com/containerd/containerd/v2/pkg/namespaces"
+	"github.com/containerd/errdefs"
+	"github.com/google/uuid"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/sirupsen/logrus"
+)
+
+// mountRefPrefix is the prefix of containerd ingest refs used to mount blobs from sibling namespaces. It shares
+// the upload prefix so that interrupted mounts are cleaned up by the reaper like interrupted uploads.
+const mountRefPrefix = uploadRefPrefix + "mount-"
+
+// mountFromSibling looks for the blob missing in the request namespace in the sibling namespaces and mounts it into
+// the request namespace so that the client doesn't have to upload it. The content is committed in the request
+// namespace under an upload lease that is released once an image referencing the blob is tagged, the same way as
+// for uploaded blobs. If containerd shares content between namespaces (the default "shared" content sharing policy),
+// the blob isn't copied at all, otherwise it's copied on the server side. It returns errdefs.ErrNotFound if the blob
+// doesn't exist in any of the sibling namespaces.
+func (b *blobStore) mountFromSibling(ctx context.Context, dgst digest.Digest) (content.Info, error) {
+	target := requestNamespace(ctx, b.client)
+	contentStore := b.client.ContentStore()
+	for _, source := range b.siblingNamespaces {
+		if source == target {
+			continue
+		}
+		sourceCtx := namespaces.WithNamespace(ctx, source)
+		info, err := contentStore.Info(sourceCtx, dgst)
+		if err != nil {
+			if errdefs.IsNotFound(err) {
+				continue
+			}
+			return content.Info{}, fmt.Errorf(
+				"get metadata for blob '%s' from containerd namespace '%s': %w", dgst, source, err,
+			)
+		}
+
+		if err = b.mount(ctx, sourceCtx, info); err != nil {
+			return content.Info{}, fmt.Errorf(
+				"mount blob '%s' from containerd namespace '%s' into '%s': %w", dgst, source, target, err,
+			)
+		}
+		siblingBlobsReused.WithLabelValues(source, target).Inc()
+		siblingBytesSaved.WithLabelValues(source, target).Add(float64(info.Size))
+		logrus.WithFields(
+			logrus.Fields{
+				"digest": dgst,
+				"size":   info.Size,
+				"source": source,
+				"target": target,
+				"repo":   b.repo.Name(),
+			},
+		).Info("Reused blob from sibling containerd namespace instead of uploading it.")
+
+		return contentStore.Info(ctx, dgst)
+	}
+
+	return content.Info{}, fmt.Errorf("blob '%s' in sibling namespaces: %w", dgst, errdefs.ErrNotFound)
+}
+
+// mount commits the blob described by info from the source namespace in the request namespace.
+func (b *blobStore) mount(ctx, sourceCtx context.Context, info content.Info) error {
+	id := uuid.NewString()
+	lease, err := b.client.LeasesService().Create(
+		ctx,
+		leases.WithRandomID(),
+		leases.WithExpiration(leaseExpiration),
+		// Label the lease so that it can be cleaned up by the reaper if the image is never tagged.
+		leases.WithLabel(uploadLeaseLabel, id),
+	)
+	if err != nil {
+		return fmt.Errorf("create containerd lease: %w", err)
+	}
+	b.uploadLeases.add(id, lease)
+
+	desc := ocispec.Descriptor{Digest: info.Digest, Size: info.Size}
+	var opts []content.Opt
+	if mediaType := info.Labels[mediaTypeLabel]; mediaType != "" {
+		opts = append(opts, content.WithLabels(map[string]string{mediaTypeLabel: mediaType}))
+	}
+
+	contentStore := b.client.ContentStore()
+	leaseCtx := leases.WithLease(ctx, lease.ID)
+	err = func() error {
+		writer, err := content.OpenWriter(
+			leaseCtx, contentStore, content.WithRef(mountRefPrefix+id), content.WithDescriptor(desc),
+		)
+		if err != nil {
+			return err
+		}
+		defer writer.Close()
+
+		ra, err := contentStore.ReaderAt(sourceCtx, desc)
+		if err != nil {
+			return err
+		}
+		defer ra.Close()
+
+		// With the shared content sharing policy the writer already has all the content so nothing is copied.
+		return content.Copy(leaseCtx, writer, content.NewReader(ra), desc.Size, desc.Digest, opts...)
+	}()
+	if err != nil && !errdefs.IsAlreadyExists(err) {
+		_ = b.client.LeasesService().Delete(ctx, lease)
+		b.uploadLeases.remove(id, lease)
+		return err
+	}
+
+	b.uploadLeases.commit(requestNamespace(ctx, b.client), id, desc.Digest)
+	b.unpackPipeline.committed(requestNamespace(ctx, b.client), id, desc.Digest, desc.Size)
+	return nil
+}
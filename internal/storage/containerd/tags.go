@@ -3,14 +3,20 @@ package containerd
 import (
 	"context"
 	"fmt"
+	"regexp"
+	"slices"
+	"strconv"
 
 	"github.com/sirupsen/logrus"
 
 	"github.com/containerd/containerd/v2/client"
+	"github.com/containerd/containerd/v2/core/content"
 	"github.com/containerd/containerd/v2/core/images"
 	"github.com/containerd/errdefs"
 	"github.com/distribution/distribution/v3"
 	"github.com/distribution/reference"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 )
 
 // tagService implements distribution.TagService backed by the containerd image store.
@@ -19,19 +25,60 @@ type tagService struct {
 	// canonicalRepo is the repository reference in a normalized form, the way containerd image store expects it,
 	// for example, "docker.io/library/ubuntu"
 	canonicalRepo reference.Named
+	// gcOnDelete enables synchronous containerd garbage collection when images are deleted.
+	gcOnDelete bool
+	// uploadLeases keeps track of containerd leases used to upload content that can be deleted once the content is
+	// referenced by an image.
+	uploadLeases *uploadLeases
+	// unpacker unpacks tagged images into a containerd snapshotter. Nil if unpacking is disabled.
+	unpacker *unpacker
+	// dockerLoader loads tagged images into the classic Docker image store. Nil if loading is disabled.
+	dockerLoader *dockerLoader
+	// dockerSource imports images missing in containerd from the classic Docker image store. Nil if disabled.
+	dockerSource *dockerSource
+	// peers pulls images missing in containerd from other unregistry instances. Nil if no peers are configured.
+	peers *peers
+	// upstream pulls images missing in containerd through from the upstream registry. Nil if disabled.
+	upstream *upstream
+	// replicator pushes tagged images to other unregistry instances. Nil if replication is disabled.
+	replicator *Replicator
+	// regenerator recreates layers deleted from the containerd content store after unpacking from the snapshots
+	// and rewrites the image manifest if they differ. Nil if regeneration is disabled.
+	regenerator *layerRegenerator
 }
 
 // Get retrieves an image descriptor by its tag from the containerd image store.
 func (t *tagService) Get(ctx context.Context, tag string) (distribution.Descriptor, error) {
 	ref, err := reference.WithTag(t.canonicalRepo, tag)
 	if err != nil {
-		return distribution.Descriptor{}, distribution.ErrManifestUnknown{
-			Name: t.canonicalRepo.Name(),
-			Tag:  tag,
-		}
+		// The distribution registry treats any manifest reference that isn't a valid digest as a tag, e.g.
+		// "sha256:invalid". Such tag can't exist so it's reported as unknown rather than an internal error.
+		return distribution.Descriptor{}, distribution.ErrTagUnknown{Tag: tag}
 	}
 
 	img, err := t.client.ImageService().Get(ctx, ref.String())
+	if err != nil && errdefs.IsNotFound(err) && t.dockerSource != nil {
+		var imported bool
+		if imported, err = t.dockerSource.importImage(ctx, ref); err != nil {
+			return distribution.Descriptor{}, err
+		}
+		if imported {
+			img, err = t.client.ImageService().Get(ctx, ref.String())
+		} else {
+			err = fmt.Errorf("image '%s' not found in containerd and docker: %w", ref.String(), errdefs.ErrNotFound)
+		}
+	}
+	if err != nil && errdefs.IsNotFound(err) && !isPeerRequest(ctx) {
+		var pulled bool
+		if pulled, err = t.pullRemote(ctx, ref); err != nil {
+			return distribution.Descriptor{}, err
+		}
+		if pulled {
+			img, err = t.client.ImageService().Get(ctx, ref.String())
+		} else {
+			err = fmt.Errorf("image '%s' not found in containerd and remotes: %w", ref.String(), errdefs.ErrNotFound)
+		}
+	}
 	if err != nil {
 		logrus.WithField("image", ref.String()).WithError(err).Debug("Failed to get image from containerd image store.")
 		if errdefs.IsNotFound(err) {
@@ -49,9 +96,47 @@ func (t *tagService) Get(ctx context.Context, tag string) (distribution.Descript
 		},
 	).Debug("Got image from containerd image store.")
 
+	if t.regenerator != nil {
+		target, err := t.regenerator.repair(ctx, img.Target)
+		if err != nil {
+			return distribution.Descriptor{}, fmt.Errorf("repair image '%s': %w", ref.String(), err)
+		}
+		return target, nil
+	}
+
 	return img.Target, nil
 }
 
+// pullRemote pulls the image missing in containerd from the first peer that has it, otherwise from the upstream
+// registry, and tags it in the containerd image store. It returns false if the image doesn't exist in any of them.
+func (t *tagService) pullRemote(ctx context.Context, ref reference.NamedTagged) (bool, error) {
+	if t.peers != nil {
+		if peer, err := t.peers.findTag(ctx, ref); err == nil {
+			pulled, err := peer.pullTag(ctx, ref)
+			if err != nil {
+				// Fall back to the upstream registry.
+				logrus.WithFields(
+					logrus.Fields{
+						"image": ref.String(),
+						"peer":  peer.host,
+					},
+				).WithError(err).Warn("Failed to pull image from peer.")
+			} else if pulled {
+				return true, nil
+			}
+		}
+	}
+
+	if t.upstream == nil {
+		return false, nil
+	}
+	pulled, err := t.upstream.pullTag(ctx, ref)
+	if err != nil {
+		return false, fmt.Errorf("pull image '%s' through from upstream registry: %w", ref.String(), err)
+	}
+	return pulled, nil
+}
+
 // Tag creates or updates the image tag in the containerd image store. The descriptor must be an image/index manifest
 // that is already present in the containerd content store.
 // It also sets garbage collection labels on the image content in the containerd content store to prevent it from being
@@ -72,11 +157,6 @@ func (t *tagService) Tag(ctx context.Context, tag string, desc distribution.Desc
 	// deleted by GC once the leases that uploaded the content are expired or deleted.
 	// See for more details:
 	// https://github.com/containerd/containerd/blob/main/docs/garbage-collection.md#garbage-collection-labels
-	//
-	// TODO: delete unnecessary leases after setting the GC labels. It seems to be non-trivial to do so, because we need
-	//  to keep track of which leases were used to upload which content and share this info between
-	//  the blobStore/blobWriter and tagService. The downside of keeping them around is the image content will be kept
-	//  in the store even if the image is deleted, until the leases expire (default is leaseExpiration).
 
 	contentStore := t.client.ContentStore()
 	// Get all the children descriptors (manifests, config, layers) for an image index or manifest.
@@ -98,8 +178,32 @@ func (t *tagService) Tag(ctx context.Context, tag string, desc distribution.Desc
 	)
 	log.Debug("Set garbage collection labels for image content in containerd content store.")
 
+	// Unpack the image before creating it so that it's ready to run once it appears in the image store. The content
+	// is still protected from garbage collection by the upload leases at this point.
+	if t.unpacker != nil {
+		if err = t.unpacker.unpack(ctx, img); err != nil {
+			return err
+		}
+	}
+
+	// Load the image into Docker before creating it in containerd so that a failed load doesn't leave the tag behind
+	// in containerd. The content is still protected from garbage collection by the upload leases at this point.
+	if t.dockerLoader != nil {
+		if err = t.dockerLoader.load(ctx, contentStore, img, reference.FamiliarString(ref)); err != nil {
+			return err
+		}
+	}
+
 	imageService := t.client.ImageService()
-	if _, err = imageService.Create(ctx, img); err != nil {
+	if t.dockerLoader != nil && t.dockerLoader.deleteImage {
+		// The image is stored by Docker now so the containerd copy is not needed. Delete the previous image with
+		// the same name if any so that it doesn't shadow the one in Docker. The content will be deleted by GC once
+		// the upload leases are released below.
+		if err = imageService.Delete(ctx, img.Name); err != nil && !errdefs.IsNotFound(err) {
+			return fmt.Errorf("delete image '%s' from containerd image store: %w", img.Name, err)
+		}
+		log.Debug("Skipped creating image in containerd image store after loading it into Docker.")
+	} else if _, err = imageService.Create(ctx, img); err != nil {
 		if !errdefs.IsAlreadyExists(err) {
 			return fmt.Errorf("create image '%s' in containerd image store: %w", ref.String(), err)
 		}
@@ -114,21 +218,272 @@ func (t *tagService) Tag(ctx context.Context, tag string, desc distribution.Desc
 		log.Debug("Created new image in containerd image store.")
 	}
 
+	// Images tagged by replication from another instance are not replicated further. Images deleted from containerd
+	// after loading them into Docker can't be replicated as their content is deleted.
+	if t.replicator != nil && !isPeerRequest(ctx) && (t.dockerLoader == nil || !t.dockerLoader.deleteImage) {
+		t.replicator.enqueue(ctx, img.Name, desc)
+	}
+
+	// The image content is now protected from garbage collection by the image and the GC labels so the leases that
+	// were used to upload the content are no longer needed. Otherwise, the content would be kept in the store even if
+	// the image is deleted, until the leases expire.
+	t.releaseUploadLeases(ctx, desc)
+
 	return nil
 }
 
-// Untag is not supported for simplicity.
-// An image could be untagged by deleting the image in containerd.
+// releaseUploadLeases deletes the containerd leases that were used to upload the content of the image. Failures are
+// only logged as the leases will expire anyway.
+func (t *tagService) releaseUploadLeases(ctx context.Context, desc distribution.Descriptor) {
+	var dgsts []digest.Digest
+	for _, d := range imageContent(ctx, t.client.ContentStore(), desc) {
+		dgsts = append(dgsts, d.Digest)
+	}
+
+	leasesService := t.client.LeasesService()
+	for _, lease := range t.uploadLeases.release(requestNamespace(ctx, t.client), dgsts) {
+		log := logrus.WithField("lease", lease.ID)
+		if err := leasesService.Delete(ctx, lease); err != nil && !errdefs.IsNotFound(err) {
+			log.WithError(err).Warn("Failed to delete containerd lease used to upload image content.")
+			continue
+		}
+		log.Debug("Deleted containerd lease used to upload image content.")
+	}
+}
+
+// Untag removes the tag by deleting the corresponding image from the containerd image store. The image content is
+// deleted by containerd garbage collection once it's no longer referenced by other images or leases.
 func (t *tagService) Untag(ctx context.Context, tag string) error {
-	return distribution.ErrUnsupported
+	ref, err := reference.WithTag(t.canonicalRepo, tag)
+	if err != nil {
+		return distribution.ErrTagUnknown{Tag: tag}
+	}
+
+	img, err := t.client.ImageService().Get(ctx, ref.String())
+	if err != nil {
+		if errdefs.IsNotFound(err) {
+			return distribution.ErrTagUnknown{Tag: tag}
+		}
+		return fmt.Errorf("get image '%s' from containerd image store: %w", ref.String(), err)
+	}
+
+	if err = t.deleteImages(ctx, []images.Image{img}); err != nil {
+		if errdefs.IsNotFound(err) {
+			return distribution.ErrTagUnknown{Tag: tag}
+		}
+		return err
+	}
+
+	return nil
 }
 
-// All should return all tags associated with the repository but discovery operations are not supported for simplicity.
+// All returns all tags associated with the repository sorted in lexical order. The tags are derived from the names of
+// images in the containerd image store that belong to the repository, e.g. "docker.io/library/ubuntu:22.04".
+// Pagination with the 'n' and 'last' query parameters is handled by the distribution tags handler which relies on
+// the returned tags being sorted.
 func (t *tagService) All(ctx context.Context) ([]string, error) {
-	return nil, distribution.ErrUnsupported
+	imgs, err := t.images(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var tags []string
+	for _, img := range imgs {
+		if ref, ok := parseTaggedImageName(img.Name); ok {
+			tags = append(tags, ref.Tag())
+		}
+	}
+	logrus.WithFields(
+		logrus.Fields{
+			"repo": t.canonicalRepo.Name(),
+			"tags": len(tags),
+		},
+	).Debug("Listed tags from containerd image store.")
+
+	if len(tags) == 0 {
+		return nil, distribution.ErrRepositoryUnknown{Name: t.canonicalRepo.Name()}
+	}
+	slices.Sort(tags)
+
+	return tags, nil
 }
 
-// Lookup should find tags associated with a descriptor but discovery operations are not supported for simplicity.
+// Lookup returns the sorted tags in the repository that point to the given descriptor either directly or through
+// an image index that contains it as a child manifest, e.g. a platform-specific manifest of a multi-platform image.
 func (t *tagService) Lookup(ctx context.Context, desc distribution.Descriptor) ([]string, error) {
-	return nil, distribution.ErrUnsupported
+	imgs, err := t.images(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var tags []string
+	// Multiple tags often point to the same index so cache the results to avoid reading it multiple times.
+	contains := make(map[digest.Digest]bool)
+	for _, img := range imgs {
+		found, err := t.indexContains(ctx, img.Target, desc.Digest, contains)
+		if err != nil {
+			return nil, err
+		}
+		if !found {
+			continue
+		}
+		if ref, ok := parseTaggedImageName(img.Name); ok {
+			tags = append(tags, ref.Tag())
+		}
+	}
+	slices.Sort(tags)
+
+	return tags, nil
+}
+
+// indexContains checks if the descriptor is the content with the given digest or an image index that contains it
+// as a child manifest, recursively. The results for indexes are cached in the cache map.
+func (t *tagService) indexContains(
+	ctx context.Context, desc ocispec.Descriptor, dgst digest.Digest, cache map[digest.Digest]bool,
+) (bool, error) {
+	if desc.Digest == dgst {
+		return true, nil
+	}
+	if !images.IsIndexType(desc.MediaType) {
+		return false, nil
+	}
+	if found, ok := cache[desc.Digest]; ok {
+		return found, nil
+	}
+
+	children, err := images.Children(ctx, t.client.ContentStore(), desc)
+	if err != nil {
+		if errdefs.IsNotFound(err) {
+			cache[desc.Digest] = false
+			return false, nil
+		}
+		return false, fmt.Errorf(
+			"get children of image index '%s' from containerd content store: %w", desc.Digest, err,
+		)
+	}
+
+	found := false
+	for _, child := range children {
+		if found, err = t.indexContains(ctx, child, dgst, cache); err != nil {
+			return false, err
+		}
+		if found {
+			break
+		}
+	}
+	cache[desc.Digest] = found
+
+	return found, nil
+}
+
+// images returns all tagged images in the containerd image store that belong to the repository.
+func (t *tagService) images(ctx context.Context) ([]images.Image, error) {
+	imgs, err := t.client.ImageService().List(ctx, repositoryImagesFilter(t.canonicalRepo))
+	if err != nil {
+		return nil, fmt.Errorf(
+			"list images for repository '%s' in containerd image store: %w", t.canonicalRepo.Name(), err,
+		)
+	}
+
+	// The filter matches by the name prefix so double-check the images belong to the repository.
+	return slices.DeleteFunc(imgs, func(img images.Image) bool {
+		ref, ok := parseTaggedImageName(img.Name)
+		return !ok || ref.Name() != t.canonicalRepo.Name()
+	}), nil
+}
+
+// deleteImages deletes the given images from the containerd image store. If gcOnDelete is enabled, containerd
+// garbage collection is run synchronously after deleting the last image and the amount of freed space is logged.
+func (t *tagService) deleteImages(ctx context.Context, imgs []images.Image) error {
+	contentStore := t.client.ContentStore()
+	imageService := t.client.ImageService()
+
+	// Collect the content of the images before deleting them to be able to calculate the freed space after GC.
+	var content []ocispec.Descriptor
+	if t.gcOnDelete {
+		for _, img := range imgs {
+			content = append(content, imageContent(ctx, contentStore, img.Target)...)
+		}
+	}
+
+	for i, img := range imgs {
+		var opts []images.DeleteOpt
+		if t.gcOnDelete && i == len(imgs)-1 {
+			opts = append(opts, images.SynchronousDelete())
+		}
+		if err := imageService.Delete(ctx, img.Name, opts...); err != nil {
+			return fmt.Errorf("delete image '%s' from containerd image store: %w", img.Name, err)
+		}
+		logrus.WithFields(
+			logrus.Fields{
+				"image":      img.Name,
+				"descriptor": img.Target,
+			},
+		).Debug("Deleted image from containerd image store.")
+	}
+
+	if !t.gcOnDelete {
+		return nil
+	}
+
+	// Content that no longer exists after the synchronous GC has been freed.
+	var freed int64
+	seen := make(map[digest.Digest]struct{})
+	for _, desc := range content {
+		if _, ok := seen[desc.Digest]; ok {
+			continue
+		}
+		seen[desc.Digest] = struct{}{}
+
+		if _, err := contentStore.Info(ctx, desc.Digest); errdefs.IsNotFound(err) {
+			freed += desc.Size
+		}
+	}
+	logrus.WithFields(
+		logrus.Fields{
+			"repo":   t.canonicalRepo.Name(),
+			"images": len(imgs),
+			"freed":  freed,
+		},
+	).Info("Deleted images and garbage collected their unreferenced content.")
+
+	return nil
+}
+
+// imageContent returns the descriptors of all the content (manifests, config, layers) of an image index or manifest
+// that is present in the content store. Missing content, e.g. manifests for other platforms, is skipped.
+func imageContent(ctx context.Context, provider content.Provider, desc ocispec.Descriptor) []ocispec.Descriptor {
+	var descs []ocispec.Descriptor
+	childrenHandler := images.ChildrenHandler(provider)
+	handler := images.HandlerFunc(func(ctx context.Context, desc ocispec.Descriptor) ([]ocispec.Descriptor, error) {
+		children, err := childrenHandler(ctx, desc)
+		if err != nil {
+			if errdefs.IsNotFound(err) {
+				return nil, nil
+			}
+			return nil, err
+		}
+		descs = append(descs, desc)
+		return children, nil
+	})
+	// Errors are ignored as the content is only used for reporting purposes.
+	_ = images.Walk(ctx, handler, desc)
+
+	return descs
+}
+
+// repositoryImagesFilter returns a containerd filter that matches tagged images in the given canonical repository.
+func repositoryImagesFilter(canonicalRepo reference.Named) string {
+	return "name~=" + strconv.Quote("^"+regexp.QuoteMeta(canonicalRepo.Name())+":")
+}
+
+// parseTaggedImageName parses a containerd image name into a normalized tagged reference. It returns false if the name
+// is not a valid reference or doesn't have a tag, e.g. a dangling image only referenced by its digest.
+func parseTaggedImageName(name string) (reference.NamedTagged, bool) {
+	ref, err := reference.ParseNormalizedNamed(name)
+	if err != nil {
+		return nil, false
+	}
+	tagged, ok := ref.(reference.NamedTagged)
+	return tagged, ok
 }
@@ -0,0 +1,92 @@
+package containerd
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/containerd/containerd/v2/client"
+	"github.com/containerd/containerd/v2/core/images"
+	"github.com/containerd/errdefs"
+	"github.com/containerd/platforms"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/sirupsen/logrus"
+)
+
+// unpacker unpacks images pushed to the registry into a containerd snapshotter so that containers can be started
+// from them immediately without unpacking the layers on the first run.
+type unpacker struct {
+	client      *client.Client
+	snapshotter string
+	// platforms are the platforms to unpack images for. Platforms the image doesn't provide are skipped.
+	platforms []ocispec.Platform
+	// pipeline applies pushed layers into the snapshotter before the image is tagged. Nil if disabled.
+	pipeline *unpackPipeline
+}
+
+// newUnpacker creates an unpacker for the given snapshotter and platforms specified in the containerd format,
+// e.g. "linux/amd64". If no platforms are specified, the host platform is used.
+func newUnpacker(client *client.Client, snapshotter string, platformSpecs []string) (*unpacker, error) {
+	if snapshotter == "" {
+		return nil, fmt.Errorf("snapshotter is required to unpack images")
+	}
+
+	var ps []ocispec.Platform
+	for _, s := range platformSpecs {
+		p, err := platforms.Parse(s)
+		if err != nil {
+			return nil, fmt.Errorf("parse unpack platform '%s': %w", s, err)
+		}
+		ps = append(ps, platforms.Normalize(p))
+	}
+	if len(ps) == 0 {
+		ps = []ocispec.Platform{platforms.DefaultSpec()}
+	}
+
+	return &unpacker{
+		client:      client,
+		snapshotter: snapshotter,
+		platforms:   ps,
+	}, nil
+}
+
+// unpack unpacks the image into the snapshotter for each configured platform the image provides.
+func (u *unpacker) unpack(ctx context.Context, img images.Image) error {
+	for _, p := range u.platforms {
+		log := logrus.WithFields(
+			logrus.Fields{
+				"image":       img.Name,
+				"platform":    platforms.Format(p),
+				"snapshotter": u.snapshotter,
+			},
+		)
+
+		cimg := client.NewImageWithPlatform(u.client, img, platforms.Only(p))
+		// Check the image provides the platform before unpacking to distinguish a missing platform from unpack errors.
+		config, err := cimg.Config(ctx)
+		if err != nil {
+			if errdefs.IsNotFound(err) {
+				log.Debug("Image doesn't provide the platform, skipping unpack.")
+				continue
+			}
+			return fmt.Errorf("get config of image '%s' for platform '%s': %w", img.Name, platforms.Format(p), err)
+		}
+
+		// Wait for the layers being applied by the pipeline. Unpack skips the layers that are already applied.
+		if err = u.pipeline.wait(ctx, config.Digest); err != nil {
+			return err
+		}
+
+		log.Debug("Unpacking image into containerd snapshotter.")
+		if err = cimg.Unpack(ctx, u.snapshotter); err != nil {
+			return fmt.Errorf(
+				"unpack image '%s' for platform '%s' into snapshotter '%s': %w",
+				img.Name, platforms.Format(p), u.snapshotter, err,
+			)
+		}
+		// The snapshots are now protected from garbage collection by the image config labels set by Unpack.
+		u.pipeline.release(ctx, config.Digest)
+		log.Info("Unpacked image into containerd snapshotter.")
+	}
+
+	return nil
+}
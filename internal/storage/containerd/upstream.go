@@ -0,0 +1,436 @@
+package containerd
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/containerd/containerd/v2/client"
+	"github.com/containerd/containerd/v2/core/content"
+	"github.com/containerd/containerd/v2/core/images"
+	"github.com/containerd/containerd/v2/core/leases"
+	"github.com/containerd/containerd/v2/core/remotes"
+	"github.com/containerd/containerd/v2/core/remotes/docker"
+	"github.com/containerd/errdefs"
+	"github.com/containerd/platforms"
+	"github.com/distribution/reference"
+	"github.com/google/uuid"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// upstreamLabel is the label set on images pulled through from the upstream registry. The value is the upstream
+	// image reference.
+	upstreamLabel = "unregistry.io/upstream"
+	// upstreamRefPrefix is the prefix of containerd ingest refs used to store content fetched from the upstream.
+	upstreamRefPrefix = "upstream-"
+)
+
+// upstream fetches images and blobs missing in containerd from an upstream registry (pull-through cache mode).
+// Pulling a tag fetches the image index, manifests and configs, stores them in the containerd content store and tags
+// the image. Layers for the host platform are fetched in the background, other layers are fetched on demand when
+// they're pulled and streamed to the client while being stored. The fetched content is protected from garbage
+// collection by a lease until the tagged image references it.
+type upstream struct {
+	client *client.Client
+	// host is the upstream registry host used in image references, e.g. "docker.io" or "registry.example.com:5000".
+	host     string
+	resolver remotes.Resolver
+	log      *logrus.Entry
+}
+
+// newUpstream creates an upstream for the registry at the given URL, e.g. "https://registry.example.com" or
+// "http://localhost:5001" for a registry without TLS. The credentials and headers sent with every request
+// are optional.
+func newUpstream(
+	client *client.Client, rawURL, username, password string, headers http.Header,
+) (*upstream, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("parse upstream registry URL '%s': %w", rawURL, err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid upstream registry URL '%s': expected http(s)://host[:port]", rawURL)
+	}
+
+	host := u.Host
+	if host == "registry-1.docker.io" || host == "index.docker.io" {
+		// Use the canonical Docker Hub domain so that official images are normalized to "library/<name>".
+		// The resolver maps it back to registry-1.docker.io.
+		host = "docker.io"
+	}
+
+	authorizer := docker.NewDockerAuthorizer(
+		docker.WithAuthCreds(func(string) (string, string, error) {
+			return username, password, nil
+		}),
+	)
+	hosts := docker.ConfigureDefaultRegistries(
+		docker.WithAuthorizer(authorizer),
+		docker.WithPlainHTTP(func(string) (bool, error) {
+			return u.Scheme == "http", nil
+		}),
+	)
+
+	return &upstream{
+		client:   client,
+		host:     host,
+		resolver: docker.NewResolver(docker.ResolverOptions{Hosts: hosts, Headers: headers}),
+		log:      logrus.WithFields(logrus.Fields{"component": "upstream", "upstream": host}),
+	}, nil
+}
+
+// ref returns the reference of the repository in the upstream registry.
+func (u *upstream) ref(repo reference.Named) (reference.Named, error) {
+	name := reference.FamiliarName(repo)
+	if reference.Domain(repo) == u.host {
+		// The repository is already in the upstream registry, e.g. when the request mirrors it.
+		name = reference.Path(repo)
+	}
+	ref, err := reference.ParseNormalizedNamed(u.host + "/" + name)
+	if err != nil {
+		return nil, fmt.Errorf("parse upstream reference for repository '%s': %w", repo.Name(), err)
+	}
+	return ref, nil
+}
+
+// resolve resolves the tag or digest of the repository in the upstream registry to a descriptor. It returns
+// errdefs.ErrNotFound if it doesn't exist.
+func (u *upstream) resolve(ctx context.Context, repo reference.Named, object string) (
+	string, ocispec.Descriptor, error,
+) {
+	ref, err := u.ref(repo)
+	if err != nil {
+		return "", ocispec.Descriptor{}, err
+	}
+	sep := ":"
+	if _, err = digest.Parse(object); err == nil {
+		sep = "@"
+	}
+
+	name, desc, err := u.resolver.Resolve(ctx, ref.String()+sep+object)
+	if err != nil {
+		return "", ocispec.Descriptor{}, fmt.Errorf("resolve '%s' in upstream registry: %w", object, err)
+	}
+	return name, desc, nil
+}
+
+// stat returns the descriptor of the blob in the repository in the upstream registry without fetching it.
+func (u *upstream) stat(ctx context.Context, repo reference.Named, dgst digest.Digest) (ocispec.Descriptor, error) {
+	_, desc, err := u.resolve(ctx, repo, dgst.String())
+	return desc, err
+}
+
+// fetch opens the content of the blob in the repository in the upstream registry.
+func (u *upstream) fetch(ctx context.Context, repo reference.Named, desc ocispec.Descriptor) (io.ReadCloser, error) {
+	ref, err := u.ref(repo)
+	if err != nil {
+		return nil, err
+	}
+	fetcher, err := u.resolver.Fetcher(ctx, ref.String())
+	if err != nil {
+		return nil, fmt.Errorf("create upstream fetcher: %w", err)
+	}
+	rc, err := fetcher.Fetch(ctx, desc)
+	if err != nil {
+		return nil, fmt.Errorf("fetch blob '%s' from upstream registry: %w", desc.Digest, err)
+	}
+	return rc, nil
+}
+
+// withLease returns a context with a new expiring lease that protects the fetched content from garbage collection
+// until it's referenced by an image, and a function to delete the lease once it is. The lease is labeled as an upload
+// lease so that the reaper deletes it if unregistry is stopped before the lease is deleted.
+func (u *upstream) withLease(ctx context.Context) (context.Context, func(), error) {
+	leasesService := u.client.LeasesService()
+	lease, err := leasesService.Create(
+		ctx, leases.WithRandomID(), leases.WithExpiration(leaseExpiration),
+		leases.WithLabel(uploadLeaseLabel, upstreamRefPrefix+u.host),
+	)
+	if err != nil {
+		return nil, nil, fmt.Errorf("create containerd lease: %w", err)
+	}
+	done := func() {
+		// Delete the lease even if the request has been canceled.
+		if err := leasesService.Delete(context.WithoutCancel(ctx), lease); err != nil && !errdefs.IsNotFound(err) {
+			u.log.WithField("lease", lease.ID).WithError(err).Warn("Failed to delete containerd lease.")
+		}
+	}
+	return leases.WithLease(ctx, lease.ID), done, nil
+}
+
+// pullTag fetches the image with the tag from the upstream registry and tags it as the local image. Only the index,
+// manifests and configs are fetched before returning. The layers for the host platform are fetched in the background
+// so that the image becomes complete in containerd, e.g. to be run by the local Docker, while the layers for other
+// platforms are fetched on demand when a client pulls them. It returns false if the tag doesn't exist in the upstream
+// registry. If the local image has been created in the meantime, e.g. by a concurrent push, it's kept as is.
+// The image is created directly in the containerd image store so it isn't unpacked, loaded into Docker or replicated
+// as images tagged through the tag service are. Its layers may not be complete yet anyway.
+func (u *upstream) pullTag(ctx context.Context, localRef reference.NamedTagged) (bool, error) {
+	name, desc, err := u.resolve(ctx, localRef, localRef.Tag())
+	if err != nil {
+		if errdefs.IsNotFound(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	log := u.log.WithFields(
+		logrus.Fields{
+			"image":      localRef.String(),
+			"descriptor": desc,
+		},
+	)
+
+	ctx, done, err := u.withLease(ctx)
+	if err != nil {
+		return false, err
+	}
+	// The content is referenced by the image once it's created.
+	defer done()
+	fetcher, err := u.resolver.Fetcher(ctx, name)
+	if err != nil {
+		return false, fmt.Errorf("create upstream fetcher: %w", err)
+	}
+
+	// Fetch the index, manifests and configs. Layers are fetched in the background or on demand.
+	contentStore := u.client.ContentStore()
+	skipLayers := images.HandlerFunc(func(_ context.Context, desc ocispec.Descriptor) ([]ocispec.Descriptor, error) {
+		if images.IsLayerType(desc.MediaType) {
+			return nil, images.ErrSkipDesc
+		}
+		return nil, nil
+	})
+	handler := images.Handlers(
+		skipLayers, remotes.FetchHandler(contentStore, fetcher), mediaTypeHandler(contentStore),
+		images.ChildrenHandler(contentStore),
+	)
+	if err = images.Dispatch(ctx, handler, nil, desc); err != nil {
+		return false, fmt.Errorf("fetch image '%s' from upstream registry: %w", name, err)
+	}
+
+	// Protect the content and the layers that will be fetched later from garbage collection the same way as on tag.
+	setGCLabelsHandler := images.SetChildrenMappedLabels(contentStore, images.ChildrenHandler(contentStore), nil)
+	if err = images.Dispatch(ctx, setGCLabelsHandler, nil, desc); err != nil {
+		return false, fmt.Errorf(
+			"set garbage collection labels for content of image '%s' in containerd content store: %w", name, err,
+		)
+	}
+
+	img := images.Image{
+		Name:   localRef.String(),
+		Target: desc,
+		Labels: map[string]string{upstreamLabel: name},
+	}
+	imageService := u.client.ImageService()
+	if _, err = imageService.Create(ctx, img); err != nil {
+		if errdefs.IsAlreadyExists(err) {
+			// Don't replace the image pushed while it was being pulled from the upstream.
+			log.Debug("Image has been created while pulling it from upstream registry, keeping it.")
+			return true, nil
+		}
+		return false, fmt.Errorf("create image '%s' in containerd image store: %w", img.Name, err)
+	}
+	log.Info("Pulled image through from upstream registry.")
+
+	// Don't cancel fetching the layers when the request completes.
+	go u.fetchLayers(context.WithoutCancel(ctx), name, desc)
+
+	return true, nil
+}
+
+// fetchLayers fetches the layers of the image for the host platform from the upstream registry that are missing in
+// the containerd content store.
+func (u *upstream) fetchLayers(ctx context.Context, name string, desc ocispec.Descriptor) {
+	log := u.log.WithField("image", name)
+	ctx, done, err := u.withLease(ctx)
+	if err != nil {
+		log.WithError(err).Warn("Failed to fetch image layers from upstream registry.")
+		return
+	}
+	defer done()
+	fetcher, err := u.resolver.Fetcher(ctx, name)
+	if err != nil {
+		log.WithError(err).Warn("Failed to fetch image layers from upstream registry.")
+		return
+	}
+
+	contentStore := u.client.ContentStore()
+	platform := platforms.Default()
+	childrenHandler := images.LimitManifests(
+		images.FilterPlatforms(images.ChildrenHandler(contentStore), platform), platform, 1,
+	)
+	// Content that already exists, e.g. the manifests or the layers fetched by clients, isn't fetched again.
+	handler := images.Handlers(
+		remotes.FetchHandler(contentStore, fetcher), mediaTypeHandler(contentStore), childrenHandler,
+	)
+	if err = images.Dispatch(ctx, handler, nil, desc); err != nil {
+		log.WithError(err).Warn("Failed to fetch image layers from upstream registry.")
+		return
+	}
+	log.Debug("Fetched image layers from upstream registry.")
+}
+
+// mediaTypeHandler returns a handler that labels the fetched content with its media type the same way as pushed
+// content so that it's served as is.
+func mediaTypeHandler(contentStore content.Store) images.HandlerFunc {
+	return func(ctx context.Context, desc ocispec.Descriptor) ([]ocispec.Descriptor, error) {
+		info := content.Info{
+			Digest: desc.Digest,
+			Labels: map[string]string{mediaTypeLabel: desc.MediaType},
+		}
+		if _, err := contentStore.Update(ctx, info, "labels."+mediaTypeLabel); err != nil {
+			return nil, fmt.Errorf("set media type label for blob '%s' in containerd content store: %w", desc.Digest, err)
+		}
+		return nil, nil
+	}
+}
+
+// fetchBlob fetches the blob from the upstream registry and stores it in the containerd content store.
+func (u *upstream) fetchBlob(ctx context.Context, repo reference.Named, desc ocispec.Descriptor) error {
+	rc, err := u.fetch(ctx, repo, desc)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	ctx, done, err := u.withLease(ctx)
+	if err != nil {
+		return err
+	}
+	// The blob is protected from garbage collection by the image that references it.
+	defer done()
+	err = content.WriteBlob(
+		ctx, u.client.ContentStore(), upstreamRefPrefix+uuid.NewString(), rc, desc, mediaTypeLabels(desc)...,
+	)
+	if err != nil && !errdefs.IsAlreadyExists(err) {
+		return fmt.Errorf("store blob '%s' from upstream registry in containerd content store: %w", desc.Digest, err)
+	}
+	u.log.WithFields(
+		logrus.Fields{
+			"digest": desc.Digest,
+			"size":   desc.Size,
+		},
+	).Debug("Fetched blob from upstream registry.")
+
+	return nil
+}
+
+// serveBlob streams the blob from the upstream registry to the client while storing it in the containerd content
+// store. The blob is stored even if the client disconnects before it's fully sent, and it's still sent to the client
+// if storing fails. If fetching the blob fails after the response header has been sent, the response is aborted so
+// that the client doesn't take the truncated blob as complete. It returns errdefs.ErrAlreadyExists if the blob has
+// been stored in the meantime, e.g. by a concurrent request, so that it can be served locally.
+func (u *upstream) serveBlob(
+	ctx context.Context, w http.ResponseWriter, r *http.Request, repo reference.Named, desc ocispec.Descriptor,
+) error {
+	// Keep fetching and storing the blob if the client disconnects.
+	ctx, done, err := u.withLease(context.WithoutCancel(ctx))
+	if err != nil {
+		return err
+	}
+	// The blob is protected from garbage collection by the image that references it.
+	defer done()
+	contentStore := u.client.ContentStore()
+	ref := upstreamRefPrefix + uuid.NewString()
+	writer, err := content.OpenWriter(ctx, contentStore, content.WithRef(ref), content.WithDescriptor(desc))
+	if err != nil {
+		return err
+	}
+	defer writer.Close()
+
+	rc, err := u.fetch(ctx, repo, desc)
+	if err != nil {
+		_ = contentStore.Abort(ctx, ref)
+		return err
+	}
+	defer rc.Close()
+
+	w.Header().Set("Content-Length", strconv.FormatInt(desc.Size, 10))
+	w.WriteHeader(http.StatusOK)
+
+	log := u.log.WithField("digest", desc.Digest)
+	store := &stickyErrorWriter{w: writer}
+	client := &stickyErrorWriter{w: w}
+	if _, err = io.Copy(io.MultiWriter(store, client), rc); err != nil {
+		_ = contentStore.Abort(ctx, ref)
+		log.WithError(err).Warn("Failed to fetch blob from upstream registry, aborting the response.")
+		// The header has already been sent so the only way to report the error is to abort the response.
+		// net/http recovers the panic and closes the connection without logging it.
+		panic(http.ErrAbortHandler)
+	}
+	if client.err != nil {
+		log.WithError(client.err).Debug("Failed to stream blob from upstream registry to client, stored it anyway.")
+	}
+	if store.err != nil {
+		_ = contentStore.Abort(ctx, ref)
+		// The client has received the full blob so the response succeeds. The blob is fetched again on the next pull.
+		log.WithError(store.err).Warn("Failed to store blob from upstream registry in containerd content store.")
+		return nil
+	}
+
+	err = writer.Commit(ctx, desc.Size, desc.Digest, mediaTypeLabels(desc)...)
+	if err != nil && !errdefs.IsAlreadyExists(err) {
+		log.WithError(err).Warn("Failed to commit blob from upstream registry to containerd content store.")
+		return nil
+	}
+	u.log.WithFields(
+		logrus.Fields{
+			"digest": desc.Digest,
+			"size":   desc.Size,
+		},
+	).Debug("Served and stored blob from upstream registry.")
+
+	return nil
+}
+
+// stickyErrorWriter is an io.Writer that records the first write error and discards all the subsequent writes so that
+// a failing destination doesn't interrupt writing to the other destinations of an io.MultiWriter.
+type stickyErrorWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (w *stickyErrorWriter) Write(p []byte) (int, error) {
+	if w.err == nil {
+		_, w.err = w.w.Write(p)
+	}
+	return len(p), nil
+}
+
+// push pushes the image with the content from the provider to the repository with the same path and tag in the
+// registry. The domain of the image name isn't part of the repository as it may not be valid in the path, e.g.
+// "localhost:5000/myapp". Content that already exists in the registry isn't pushed again.
+func (u *upstream) push(
+	ctx context.Context, localRef reference.NamedTagged, desc ocispec.Descriptor, provider content.Provider,
+) error {
+	ref, err := reference.ParseNamed(u.host + "/" + reference.Path(localRef))
+	if err != nil {
+		return fmt.Errorf("parse reference for image '%s' in '%s': %w", localRef.String(), u.host, err)
+	}
+	tagged, err := reference.WithTag(ref, localRef.Tag())
+	if err != nil {
+		return fmt.Errorf("tag reference '%s': %w", ref.String(), err)
+	}
+
+	pusher, err := u.resolver.Pusher(ctx, tagged.String())
+	if err != nil {
+		return fmt.Errorf("create pusher: %w", err)
+	}
+	if err = remotes.PushContent(ctx, pusher, desc, provider, nil, platforms.All, nil); err != nil {
+		return fmt.Errorf("push image '%s' to '%s': %w", localRef.String(), u.host, err)
+	}
+	return nil
+}
+
+// mediaTypeLabels returns the options to label the content fetched from the upstream with its media type.
+func mediaTypeLabels(desc ocispec.Descriptor) []content.Opt {
+	if desc.MediaType == "" {
+		return nil
+	}
+	return []content.Opt{content.WithLabels(map[string]string{mediaTypeLabel: desc.MediaType})}
+}
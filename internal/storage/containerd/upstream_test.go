@@ -0,0 +1,206 @@
+package containerd
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/containerd/errdefs"
+	"github.com/distribution/distribution/v3/configuration"
+	"github.com/distribution/distribution/v3/registry/handlers"
+	_ "github.com/distribution/distribution/v3/registry/storage/driver/inmemory"
+	"github.com/distribution/reference"
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// newTestRegistry starts a distribution registry with in-memory storage to be used as an upstream.
+func newTestRegistry(t *testing.T) *httptest.Server {
+	t.Helper()
+	config := &configuration.Configuration{
+		Storage: configuration.Storage{
+			"inmemory": configuration.Parameters{},
+			"maintenance": configuration.Parameters{
+				"uploadpurging": map[interface{}]interface{}{
+					"enabled": false,
+				},
+			},
+		},
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	server := httptest.NewServer(handlers.NewApp(ctx, config))
+	t.Cleanup(func() {
+		server.Close()
+		cancel()
+	})
+	return server
+}
+
+// pushBlob uploads the blob to the repository in the registry with a monolithic upload.
+func pushBlob(t *testing.T, registryURL, repo string, blob []byte) ocispec.Descriptor {
+	t.Helper()
+	dgst := digest.FromBytes(blob)
+	resp, err := http.Post(registryURL+"/v2/"+repo+"/blobs/uploads/", "", nil)
+	if err != nil {
+		t.Fatalf("start upload: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("start upload: unexpected status %d", resp.StatusCode)
+	}
+
+	location, err := resp.Location()
+	if err != nil {
+		t.Fatalf("get upload location: %v", err)
+	}
+	query := location.Query()
+	query.Set("digest", dgst.String())
+	location.RawQuery = query.Encode()
+	req, err := http.NewRequest(http.MethodPut, location.String(), bytes.NewReader(blob))
+	if err != nil {
+		t.Fatalf("create upload request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	if resp, err = http.DefaultClient.Do(req); err != nil {
+		t.Fatalf("complete upload: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("complete upload: unexpected status %d", resp.StatusCode)
+	}
+
+	return ocispec.Descriptor{Digest: dgst, Size: int64(len(blob))}
+}
+
+// pushImage pushes a single layer image to the repository in the registry and tags it.
+func pushImage(t *testing.T, registryURL, repo, tag string) (ocispec.Descriptor, ocispec.Descriptor) {
+	t.Helper()
+	layer := pushBlob(t, registryURL, repo, []byte("layer content"))
+	layer.MediaType = ocispec.MediaTypeImageLayerGzip
+	config := pushBlob(t, registryURL, repo, []byte(`{"architecture":"amd64","os":"linux"}`))
+	config.MediaType = ocispec.MediaTypeImageConfig
+
+	manifest, err := json.Marshal(ocispec.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ocispec.MediaTypeImageManifest,
+		Config:    config,
+		Layers:    []ocispec.Descriptor{layer},
+	})
+	if err != nil {
+		t.Fatalf("marshal manifest: %v", err)
+	}
+
+	req, err := http.NewRequest(
+		http.MethodPut, registryURL+"/v2/"+repo+"/manifests/"+tag, bytes.NewReader(manifest),
+	)
+	if err != nil {
+		t.Fatalf("create manifest request: %v", err)
+	}
+	req.Header.Set("Content-Type", ocispec.MediaTypeImageManifest)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("push manifest: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("push manifest: unexpected status %d", resp.StatusCode)
+	}
+
+	return ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageManifest,
+		Digest:    digest.FromBytes(manifest),
+		Size:      int64(len(manifest)),
+	}, layer
+}
+
+func TestUpstream(t *testing.T) {
+	server := newTestRegistry(t)
+	manifest, layer := pushImage(t, server.URL, "myapp", "latest")
+
+	u, err := newUpstream(nil, server.URL, "", "", nil)
+	if err != nil {
+		t.Fatalf("create upstream: %v", err)
+	}
+	repo, err := reference.WithName("myapp")
+	if err != nil {
+		t.Fatalf("parse repository name: %v", err)
+	}
+	ctx := context.Background()
+
+	t.Run("resolve tag", func(t *testing.T) {
+		_, desc, err := u.resolve(ctx, repo, "latest")
+		if err != nil {
+			t.Fatalf("resolve tag: %v", err)
+		}
+		if desc.Digest != manifest.Digest || desc.MediaType != manifest.MediaType {
+			t.Errorf("expected descriptor %+v, got %+v", manifest, desc)
+		}
+	})
+
+	t.Run("resolve missing tag", func(t *testing.T) {
+		_, _, err := u.resolve(ctx, repo, "missing")
+		if !errdefs.IsNotFound(err) {
+			t.Errorf("expected not found error, got %v", err)
+		}
+	})
+
+	t.Run("stat blob", func(t *testing.T) {
+		desc, err := u.stat(ctx, repo, layer.Digest)
+		if err != nil {
+			t.Fatalf("stat blob: %v", err)
+		}
+		if desc.Digest != layer.Digest || desc.Size != layer.Size {
+			t.Errorf("expected descriptor %+v, got %+v", layer, desc)
+		}
+	})
+
+	t.Run("stat missing blob", func(t *testing.T) {
+		_, err := u.stat(ctx, repo, digest.FromString("missing"))
+		if !errdefs.IsNotFound(err) {
+			t.Errorf("expected not found error, got %v", err)
+		}
+	})
+
+	t.Run("fetch blob", func(t *testing.T) {
+		rc, err := u.fetch(ctx, repo, layer)
+		if err != nil {
+			t.Fatalf("fetch blob: %v", err)
+		}
+		defer rc.Close()
+		blob, err := io.ReadAll(rc)
+		if err != nil {
+			t.Fatalf("read blob: %v", err)
+		}
+		if string(blob) != "layer content" {
+			t.Errorf("expected blob %q, got %q", "layer content", blob)
+		}
+	})
+}
+
+func TestNewUpstreamInvalidURL(t *testing.T) {
+	for _, rawURL := range []string{"registry.example.com", "ftp://registry.example.com", "https://"} {
+		if _, err := newUpstream(nil, rawURL, "", "", nil); err == nil {
+			t.Errorf("expected error for upstream URL %q", rawURL)
+		}
+	}
+}
+
+func TestUpstreamRefDockerHub(t *testing.T) {
+	u, err := newUpstream(nil, "https://registry-1.docker.io", "", "", nil)
+	if err != nil {
+		t.Fatalf("create upstream: %v", err)
+	}
+	repo, _ := reference.WithName("ubuntu")
+	ref, err := u.ref(repo)
+	if err != nil {
+		t.Fatalf("get upstream reference: %v", err)
+	}
+	if ref.String() != "docker.io/library/ubuntu" {
+		t.Errorf("expected reference %q, got %q", "docker.io/library/ubuntu", ref.String())
+	}
+}
@@ -6,10 +6,12 @@ import (
 	"fmt"
 	"net/http"
 
+	"github.com/containerd/containerd/v2/client"
 	"github.com/distribution/distribution/v3/configuration"
 	"github.com/distribution/distribution/v3/registry/handlers"
 	// Register filesystem storage driver.
 	_ "github.com/distribution/distribution/v3/registry/storage/driver/filesystem"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/psviderski/unregistry/internal/storage/containerd"
 	"github.com/sirupsen/logrus"
 )
@@ -18,6 +20,11 @@ import (
 type Registry struct {
 	app    *handlers.App
 	server *http.Server
+	// metricsServer serves Prometheus metrics. Nil if metrics are disabled.
+	metricsServer *http.Server
+	client        *client.Client
+	// cancel cancels the context of the registry app to stop its background tasks.
+	cancel context.CancelFunc
 }
 
 // NewRegistry creates a new registry from the given configuration.
@@ -38,7 +45,39 @@ func NewRegistry(cfg Config) (*Registry, error) {
 		return nil, fmt.Errorf("invalid log formatter: '%s'; expected 'json' or 'text'", cfg.LogFormatter)
 	}
 
+	// Peers and replication targets are expected to share the authentication configuration, so requests to them would
+	// be rejected without credentials.
+	usesPeers := len(cfg.Peers) > 0 || cfg.PeerSRV != "" || len(cfg.ReplicationTargets) > 0
+	if cfg.HtpasswdPath != "" && usesPeers && (cfg.PeerUsername == "" || cfg.PeerPassword == "") {
+		return nil, errors.New(
+			"peers and replication targets require a peer username and password when authentication is enabled",
+		)
+	}
+
+	// The containerd client is shared between the registry storage middleware and the API extensions not supported by
+	// the distribution registry.
+	cli, err := containerd.NewClient(cfg.ContainerdSock, cfg.ContainerdNamespace)
+	if err != nil {
+		return nil, err
+	}
+
+	// The replicator is shared between the registry storage middleware that queues tagged images and the replication
+	// status endpoint.
+	var replicator *containerd.Replicator
+	if len(cfg.ReplicationTargets) > 0 {
+		if replicator, err = containerd.NewReplicator(
+			cli, cfg.ReplicationTargets, cfg.ReplicationQueue, cfg.PeerUsername, cfg.PeerPassword,
+		); err != nil {
+			_ = cli.Close()
+			return nil, err
+		}
+	}
+
 	distConfig := &configuration.Configuration{
+		Catalog: configuration.Catalog{
+			// The default maximum number of entries in the /v2/_catalog response used by distribution.
+			MaxEntries: 1000,
+		},
 		Storage: configuration.Storage{
 			"filesystem": configuration.Parameters{
 				"rootdirectory": "/tmp/registry", // Dummy storage driver
@@ -54,27 +93,103 @@ func NewRegistry(cfg Config) (*Registry, error) {
 				{
 					Name: containerd.MiddlewareName,
 					Options: configuration.Parameters{
-						"namespace": cfg.ContainerdNamespace,
-						"sock":      cfg.ContainerdSock,
+						"client":            cli,
+						"contentroot":       cfg.ContainerdContentRoot,
+						"gcondelete":        cfg.GCOnDelete,
+						"staleuploadage":    cfg.StaleUploadAge,
+						"unpack":            cfg.Unpack,
+						"snapshotter":       cfg.Snapshotter,
+						"unpackplatforms":   cfg.UnpackPlatforms,
+						"unpackpipeline":    cfg.UnpackPipeline,
+						"dockerload":        cfg.DockerLoad,
+						"dockersock":        cfg.DockerSock,
+						"dockerloaddelete":  cfg.DockerLoadDelete,
+						"dockerfallback":    cfg.DockerFallback,
+						"regeneratelayers":  cfg.RegenerateLayers,
+						"namespaces":        cfg.ContainerdNamespaces,
+						"siblingnamespaces": cfg.SiblingNamespaces,
+						"peers":             cfg.Peers,
+						"peersrv":           cfg.PeerSRV,
+						"peerusername":      cfg.PeerUsername,
+						"peerpassword":      cfg.PeerPassword,
+						"upstream":          cfg.Upstream,
+						"upstreamusername":  cfg.UpstreamUsername,
+						"upstreampassword":  cfg.UpstreamPassword,
+						"replicator":        replicator,
+						"namemappings":      cfg.NameMappings,
 					},
 				},
 			},
 		},
 	}
-	app := handlers.NewApp(context.Background(), distConfig)
+	ctx, cancel := context.WithCancel(context.Background())
+	app := handlers.NewApp(ctx, distConfig)
+	var handler http.Handler = app
+	if cfg.ContainerdContentRoot != "" {
+		handler = containerd.NewSendfileHandler(handler)
+	}
+	handler = containerd.NewReferrersHandler(cli, handler)
+	handler = containerd.NewMirrorHandler(handler)
+	handler = containerd.NewPeerHandler(handler)
+	handler = containerd.NewBlobHeadHandler(handler)
+	handler = containerd.NewRepositoryHandler(handler)
+	if replicator != nil {
+		handler = containerd.NewReplicationStatusHandler(replicator, handler)
+		// The context is canceled when the registry is shut down.
+		go replicator.Run(ctx)
+	}
+	// The namespace handler must come first as it may strip the namespace from the repository name in the path.
+	if handler, err = containerd.NewNamespaceHandler(
+		cfg.ContainerdNamespace, cfg.ContainerdNamespaces, cfg.NamespaceHosts, handler,
+	); err != nil {
+		cancel()
+		_ = cli.Close()
+		return nil, err
+	}
+	// Authentication wraps all the handlers so that the API extensions served outside the registry app are protected
+	// as well.
+	if cfg.HtpasswdPath != "" {
+		if handler, err = containerd.NewAuthHandler(cfg.HtpasswdPath, handler); err != nil {
+			cancel()
+			_ = cli.Close()
+			return nil, err
+		}
+	}
 	server := &http.Server{
 		Addr:    cfg.Addr,
-		Handler: app,
+		Handler: handler,
+	}
+
+	var metricsServer *http.Server
+	if cfg.MetricsAddr != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", promhttp.Handler())
+		metricsServer = &http.Server{
+			Addr:    cfg.MetricsAddr,
+			Handler: mux,
+		}
 	}
 
 	return &Registry{
-		app:    app,
-		server: server,
+		app:           app,
+		server:        server,
+		metricsServer: metricsServer,
+		client:        cli,
+		cancel:        cancel,
 	}, nil
 }
 
 // ListenAndServe starts the HTTP server for the registry.
 func (r *Registry) ListenAndServe() error {
+	if r.metricsServer != nil {
+		go func() {
+			logrus.WithField("addr", r.metricsServer.Addr).Info("Starting metrics server.")
+			if err := r.metricsServer.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				logrus.WithError(err).Error("Metrics server failed.")
+			}
+		}()
+	}
+
 	logrus.WithField("addr", r.server.Addr).Info("Starting registry server.")
 	if err := r.server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
 		return err
@@ -85,8 +200,17 @@ func (r *Registry) ListenAndServe() error {
 // Shutdown gracefully shuts down the registry's HTTP server and application object.
 func (r *Registry) Shutdown(ctx context.Context) error {
 	err := r.server.Shutdown(ctx)
+	if r.metricsServer != nil {
+		if metricsErr := r.metricsServer.Shutdown(ctx); metricsErr != nil {
+			err = errors.Join(err, metricsErr)
+		}
+	}
+	r.cancel()
 	if appErr := r.app.Shutdown(); appErr != nil {
 		err = errors.Join(err, appErr)
 	}
+	if clientErr := r.client.Close(); clientErr != nil {
+		err = errors.Join(err, clientErr)
+	}
 	return err
 }
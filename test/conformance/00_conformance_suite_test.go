@@ -21,11 +21,14 @@ func TestConformance(t *testing.T) {
 	// Configure environment variables for conformance tests.
 	os.Setenv("OCI_ROOT_URL", url)
 	os.Setenv("OCI_NAMESPACE", "conformance")
-	// Enable push and pull tests only. Discover and management are not supported yet.
+	os.Setenv("OCI_CROSSMOUNT_NAMESPACE", "conformance-crossmount")
+	// Blobs are only mounted when the source repository is given in the from parameter.
+	os.Setenv("OCI_AUTOMATIC_CROSSMOUNT", "0")
+	// Enable all test workflows.
 	os.Setenv("OCI_TEST_PULL", "1")
 	os.Setenv("OCI_TEST_PUSH", "1")
-	//os.Setenv("OCI_TEST_CONTENT_DISCOVERY", "1")
-	//os.Setenv("OCI_TEST_CONTENT_MANAGEMENT", "1")
+	os.Setenv("OCI_TEST_CONTENT_DISCOVERY", "1")
+	os.Setenv("OCI_TEST_CONTENT_MANAGEMENT", "1")
 	// Set debug mode for better logging.
 	//os.Setenv("OCI_DEBUG", "1")
 
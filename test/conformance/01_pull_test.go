@@ -235,7 +235,6 @@ var test01Pull = func() {
 
 		g.Context("Error codes", func() {
 			g.Specify("400 response body should contain OCI-conforming JSON message", func() {
-				g.Skip("Skipped as the distribution package returns 500 for invalid manifests")
 				SkipIfDisabled(pull)
 				req := client.NewRequest(reggie.GET, "/v2/<name>/manifests/<reference>",
 					reggie.WithReference("sha256:totallywrong")).
@@ -0,0 +1,132 @@
+package e2e
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUnregistryBlobs(t *testing.T) {
+	ctx := context.Background()
+
+	registryPort := 50005
+	_, sshPort := runUnregistryDinD(t, registryPort, true)
+	registryAddr := fmt.Sprintf("localhost:%d", registryPort)
+
+	t.Run("release upload leases once the image is pushed", func(t *testing.T) {
+		listLeases := func() []string {
+			return strings.Fields(
+				runSSH(t, sshPort, "ctr --address /run/docker/containerd/containerd.sock -n moby leases ls -q"),
+			)
+		}
+		existing := listLeases()
+
+		registryImage := fmt.Sprintf("%s/busybox:leases", registryAddr)
+		rc, err := newRegClient(registryImage)
+		require.NoError(t, err, "Failed to create regclient for registry image '%s'", registryImage)
+		defer rc.Close(ctx)
+		require.NoError(
+			t, rc.pushTarballImage(ctx, filepath.Join("images", "busybox:1.36.1-musl-amd64_oci.tar")),
+			"Failed to push tarball image to unregistry",
+		)
+
+		// The leases protecting the uploaded blobs from garbage collection are deleted once the image references them.
+		assert.Subset(t, existing, listLeases(), "Upload leases should be released after the push")
+	})
+
+	t.Run("mount blob from another repository", func(t *testing.T) {
+		dgst := uploadBlob(t, registryAddr, "blobs/source", []byte("mounted blob"))
+
+		resp := registryRequest(t, http.MethodPost, registryAddr, "blobs/target",
+			fmt.Sprintf("blobs/uploads/?mount=%s&from=%s", dgst, url.QueryEscape("blobs/source")))
+		assert.Equal(t, http.StatusCreated, resp.StatusCode, "Existing blob should be mounted without an upload")
+		location, err := resp.Location()
+		require.NoError(t, err, "Mount response should have a location")
+		assert.Equal(t, fmt.Sprintf("/v2/blobs/target/blobs/%s", dgst), location.Path)
+
+		missing := digest.FromString("missing blob")
+		resp = registryRequest(t, http.MethodPost, registryAddr, "blobs/target",
+			fmt.Sprintf("blobs/uploads/?mount=%s&from=%s", missing, url.QueryEscape("blobs/source")))
+		assert.Equal(t, http.StatusAccepted, resp.StatusCode, "Missing blob should fall back to an upload session")
+	})
+
+	t.Run("delete blob that isn't referenced by any image", func(t *testing.T) {
+		dgst := uploadBlob(t, registryAddr, "blobs/unreferenced", []byte("unreferenced blob"))
+
+		resp := registryRequest(t, http.MethodDelete, registryAddr, "blobs/unreferenced", "blobs/"+dgst.String())
+		assert.Equal(t, http.StatusAccepted, resp.StatusCode, "Unreferenced blob should be deleted")
+
+		resp = registryRequest(t, http.MethodGet, registryAddr, "blobs/unreferenced", "blobs/"+dgst.String())
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode, "Deleted blob should not be found")
+
+		resp = registryRequest(t, http.MethodDelete, registryAddr, "blobs/unreferenced", "blobs/"+dgst.String())
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode, "Deleting a missing blob should fail with not found")
+	})
+
+	t.Run("refuse to delete blob referenced by an image", func(t *testing.T) {
+		registryImage := fmt.Sprintf("%s/busybox:blobs", registryAddr)
+		rc, err := newRegClient(registryImage)
+		require.NoError(t, err, "Failed to create regclient for registry image '%s'", registryImage)
+		defer rc.Close(ctx)
+		require.NoError(
+			t, rc.pushTarballImage(ctx, filepath.Join("images", "busybox:1.36.1-musl-amd64_oci.tar")),
+			"Failed to push tarball image to unregistry",
+		)
+
+		layers := manifestLayers(t, registryAddr, "busybox", "blobs")
+		require.NotEmpty(t, layers, "Image manifest should have layers")
+
+		resp := registryRequest(t, http.MethodDelete, registryAddr, "busybox", "blobs/"+layers[0].String())
+		assert.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode, "Referenced blob should not be deleted")
+
+		resp = registryRequest(t, http.MethodGet, registryAddr, "busybox", "blobs/"+layers[0].String())
+		assert.Equal(t, http.StatusOK, resp.StatusCode, "Referenced blob should still be available")
+	})
+}
+
+// registryRequest sends a request without a body to the registry API path of the repository, e.g.
+// "manifests/latest", and returns the response with the body already closed.
+func registryRequest(t *testing.T, method, registryAddr, repo, path string) *http.Response {
+	t.Helper()
+
+	req, err := http.NewRequest(method, fmt.Sprintf("http://%s/v2/%s/%s", registryAddr, repo, path), nil)
+	require.NoError(t, err)
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err, "Failed to send %s request to '%s'", method, req.URL)
+	require.NoError(t, resp.Body.Close())
+
+	return resp
+}
+
+// uploadBlob uploads the blob to the repository in a single PUT request and returns its digest.
+func uploadBlob(t *testing.T, registryAddr, repo string, blob []byte) digest.Digest {
+	t.Helper()
+
+	resp := registryRequest(t, http.MethodPost, registryAddr, repo, "blobs/uploads/")
+	require.Equal(t, http.StatusAccepted, resp.StatusCode, "Failed to start blob upload")
+	location, err := resp.Location()
+	require.NoError(t, err, "Blob upload response should have a location")
+
+	dgst := digest.FromBytes(blob)
+	query := location.Query()
+	query.Set("digest", dgst.String())
+	location.RawQuery = query.Encode()
+	req, err := http.NewRequest(http.MethodPut, location.String(), bytes.NewReader(blob))
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", "application/octet-stream")
+	resp, err = http.DefaultClient.Do(req)
+	require.NoError(t, err, "Failed to upload blob")
+	require.NoError(t, resp.Body.Close())
+	require.Equal(t, http.StatusCreated, resp.StatusCode, "Failed to upload blob")
+
+	return dgst
+}
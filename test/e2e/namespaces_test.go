@@ -0,0 +1,76 @@
+package e2e
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/docker/docker/api/types/image"
+	"github.com/docker/docker/client"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/testcontainers/testcontainers-go"
+)
+
+func TestUnregistryNamespaces(t *testing.T) {
+	ctx := context.Background()
+
+	registryPort := 50007
+	_, sshPort := runUnregistryDinD(
+		t, registryPort, true,
+		testcontainers.WithEnv(map[string]string{
+			"UNREGISTRY_CONTAINERD_NAMESPACES": "k8s.io",
+			"UNREGISTRY_SIBLING_NAMESPACES":    "moby",
+		}),
+	)
+	registryAddr := fmt.Sprintf("localhost:%d", registryPort)
+
+	localCli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	require.NoError(t, err)
+	defer localCli.Close()
+
+	t.Run("docker push reuses blobs from sibling namespace", func(t *testing.T) {
+		imageName := "traefik/whoami:v1.10.1"
+		registryImage := fmt.Sprintf("%s/%s", registryAddr, imageName)
+		// The first component of the repository name selects the containerd namespace.
+		registryImageK8s := fmt.Sprintf("%s/k8s.io/%s", registryAddr, imageName)
+		platform := "linux/amd64"
+		ociPlatform := ocispec.Platform{Architecture: "amd64", OS: "linux"}
+
+		t.Cleanup(func() {
+			for _, img := range []string{imageName, registryImage, registryImageK8s} {
+				_, err := localCli.ImageRemove(ctx, img, image.RemoveOptions{PruneChildren: true})
+				if !client.IsErrNotFound(err) {
+					assert.NoError(t, err)
+				}
+			}
+		})
+
+		require.NoError(
+			t, pullImage(ctx, localCli, imageName, image.PullOptions{Platform: platform}),
+			"Failed to pull image '%s' locally", imageName,
+		)
+		for _, img := range []string{registryImage, registryImageK8s} {
+			require.NoError(
+				t, localCli.ImageTag(ctx, imageName, img),
+				"Failed to tag image '%s' as '%s' locally", imageName, img,
+			)
+		}
+
+		_, err := pushImage(ctx, localCli, registryImage, image.PushOptions{Platform: &ociPlatform})
+		require.NoError(t, err, "Failed to push image '%s' to the moby namespace", registryImage)
+
+		// The layers exist in the sibling moby namespace so they must be reused rather than uploaded to k8s.io.
+		output, err := pushImage(ctx, localCli, registryImageK8s, image.PushOptions{Platform: &ociPlatform})
+		require.NoError(t, err, "Failed to push image '%s' to the k8s.io namespace", registryImageK8s)
+		img, _, err := localCli.ImageInspectWithRaw(ctx, imageName)
+		require.NoError(t, err, "Failed to inspect image '%s' locally", imageName)
+		assert.Equal(t, len(img.RootFS.Layers), strings.Count(output, "Layer already exists"),
+			"Layers from the sibling namespace should not be uploaded: %s", output)
+
+		images := runSSH(t, sshPort, "ctr --address /run/docker/containerd/containerd.sock -n k8s.io images ls -q")
+		assert.Contains(t, images, imageName, "Image should be stored in the k8s.io namespace")
+	})
+}
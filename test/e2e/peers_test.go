@@ -0,0 +1,127 @@
+package e2e
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"testing"
+
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/image"
+	"github.com/docker/docker/client"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/testcontainers/testcontainers-go"
+	"github.com/testcontainers/testcontainers-go/network"
+)
+
+func TestUnregistryPeers(t *testing.T) {
+	ctx := context.Background()
+
+	nw, err := network.New(ctx)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		assert.NoError(t, nw.Remove(ctx))
+	})
+
+	// Unregistry A has the image pushed to it, unregistry B looks up the content it misses in A.
+	registryPortA := 50003
+	_, _ = runUnregistryDinD(t, registryPortA, true, network.WithNetwork([]string{"unregistry-a"}, nw))
+	registryPortB := 50004
+	dockerPortB, _ := runUnregistryDinD(
+		t, registryPortB, true,
+		network.WithNetwork([]string{"unregistry-b"}, nw),
+		testcontainers.WithEnv(map[string]string{"UNREGISTRY_PEERS": "http://unregistry-a:5000"}),
+	)
+
+	remoteCliB, err := client.NewClientWithOpts(
+		client.WithHost("tcp://localhost:"+dockerPortB),
+		client.WithAPIVersionNegotiation(),
+	)
+	require.NoError(t, err)
+	defer remoteCliB.Close()
+
+	localCli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	require.NoError(t, err)
+	defer localCli.Close()
+
+	t.Run("pull image that only a peer has", func(t *testing.T) {
+		registryAddrA := fmt.Sprintf("localhost:%d", registryPortA)
+		registryAddrB := fmt.Sprintf("localhost:%d", registryPortB)
+		registryImageA := fmt.Sprintf("%s/busybox:peers", registryAddrA)
+		rc, err := newRegClient(registryImageA)
+		require.NoError(t, err, "Failed to create regclient for registry image '%s'", registryImageA)
+		defer rc.Close(ctx)
+		require.NoError(
+			t, rc.pushTarballImage(ctx, filepath.Join("images", "busybox:1.36.1-musl-amd64_oci.tar")),
+			"Failed to push tarball image to unregistry A",
+		)
+
+		// Unregistry B doesn't have the image so it must fetch the manifest and blobs from the peer A.
+		layers := manifestLayers(t, registryAddrB, "busybox", "peers")
+		assert.Equal(t, manifestLayers(t, registryAddrA, "busybox", "peers"), layers,
+			"Image pulled from unregistry B should have the same layers as the one pushed to A")
+		for _, layer := range layers {
+			resp, err := http.Get(fmt.Sprintf("http://%s/v2/busybox/blobs/%s", registryAddrB, layer))
+			require.NoError(t, err, "Failed to get blob '%s' from unregistry B", layer)
+			require.Equal(t, http.StatusOK, resp.StatusCode, "Failed to get blob '%s' from unregistry B", layer)
+			dgst, err := digest.FromReader(resp.Body)
+			require.NoError(t, resp.Body.Close())
+			require.NoError(t, err, "Failed to read blob '%s' from unregistry B", layer)
+			assert.Equal(t, layer, dgst, "Blob pulled from unregistry B should have the same content as in A")
+		}
+	})
+
+	t.Run("docker push uploads blobs that only a peer has", func(t *testing.T) {
+		imageName := "traefik/whoami:v1.10.3"
+		registryImageA := fmt.Sprintf("localhost:%d/%s", registryPortA, imageName)
+		registryImageB := fmt.Sprintf("localhost:%d/%s", registryPortB, imageName)
+		platform := "linux/amd64"
+		ociPlatform := ocispec.Platform{Architecture: "amd64", OS: "linux"}
+
+		t.Cleanup(func() {
+			for _, img := range []string{imageName, registryImageA, registryImageB} {
+				_, err := localCli.ImageRemove(ctx, img, image.RemoveOptions{PruneChildren: true})
+				if !client.IsErrNotFound(err) {
+					assert.NoError(t, err)
+				}
+			}
+		})
+
+		require.NoError(
+			t, pullImage(ctx, localCli, imageName, image.PullOptions{Platform: platform}),
+			"Failed to pull image '%s' locally", imageName,
+		)
+		for _, registryImage := range []string{registryImageA, registryImageB} {
+			require.NoError(
+				t, localCli.ImageTag(ctx, imageName, registryImage),
+				"Failed to tag image '%s' as '%s' locally", imageName, registryImage,
+			)
+		}
+
+		_, err := pushImage(ctx, localCli, registryImageA, image.PushOptions{Platform: &ociPlatform})
+		require.NoError(t, err, "Failed to push image '%s' to unregistry A", registryImageA)
+
+		// The layers exist in the peer A but not in B so they must be uploaded to B rather than reported as existing.
+		output, err := pushImage(ctx, localCli, registryImageB, image.PushOptions{Platform: &ociPlatform})
+		require.NoError(t, err, "Failed to push image '%s' to unregistry B", registryImageB)
+		assert.NotContains(t, output, "Layer already exists", "Layers only a peer has should be uploaded")
+
+		summary, err := remoteCliB.ImageList(ctx, image.ListOptions{
+			Filters: filters.NewArgs(
+				filters.Arg("reference", imageName),
+			),
+			Manifests: true,
+		})
+		require.NoError(t, err, "Failed to list image '%s' in remote Docker B", imageName)
+		require.Len(t, summary, 1, "Image '%s' should be available in remote Docker B", imageName)
+		for _, m := range summary[0].Manifests {
+			if m.Kind == image.ManifestKindImage {
+				assert.True(t, m.Available, "Image content '%s' should be available in remote Docker B", m.ID)
+			}
+		}
+	})
+}
@@ -0,0 +1,50 @@
+package e2e
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/testcontainers/testcontainers-go"
+)
+
+func TestUnregistryUnpack(t *testing.T) {
+	ctx := context.Background()
+
+	registryPort := 50006
+	_, sshPort := runUnregistryDinD(
+		t, registryPort, true,
+		testcontainers.WithEnv(map[string]string{
+			"UNREGISTRY_UNPACK":           "true",
+			"UNREGISTRY_UNPACK_PLATFORMS": "linux/amd64",
+		}),
+	)
+	registryAddr := fmt.Sprintf("localhost:%d", registryPort)
+
+	t.Run("unpack pushed image into the snapshotter", func(t *testing.T) {
+		registryImage := fmt.Sprintf("%s/busybox:unpack", registryAddr)
+		rc, err := newRegClient(registryImage)
+		require.NoError(t, err, "Failed to create regclient for registry image '%s'", registryImage)
+		defer rc.Close(ctx)
+		require.NoError(
+			t, rc.pushTarballImage(ctx, filepath.Join("images", "busybox:1.36.1-musl-amd64_oci.tar")),
+			"Failed to push tarball image to unregistry",
+		)
+
+		// The image is unpacked by the time the push finishes so containers can be started without unpacking layers.
+		output := runSSH(t, sshPort, "ctr --address /run/docker/containerd/containerd.sock -n moby images check")
+		var status string
+		for _, line := range strings.Split(output, "\n") {
+			if strings.Contains(line, "busybox:unpack") {
+				status = line
+			}
+		}
+		require.NotEmpty(t, status, "Image should be in containerd: %s", output)
+		fields := strings.Fields(status)
+		assert.Equal(t, "true", fields[len(fields)-1], "Image should be unpacked: %s", status)
+	})
+}
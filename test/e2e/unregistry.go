@@ -2,14 +2,21 @@ package e2e
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
 	"path/filepath"
 	"strings"
 	"testing"
 	"time"
 
 	"github.com/docker/docker/api/types"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"github.com/testcontainers/testcontainers-go"
@@ -17,8 +24,11 @@ import (
 )
 
 // runUnregistryDinD starts unregistry in a Docker-in-Docker container. It returns the mapped Docker and SSH ports.
-// The containerdStore parameter specifies whether to use containerd image store.
-func runUnregistryDinD(t *testing.T, mappedRegistryPort int, containerdStore bool) (string, string) {
+// The containerdStore parameter specifies whether to use containerd image store. The optional opts customise
+// the container, e.g. configure unregistry with environment variables or attach the container to a network.
+func runUnregistryDinD(
+	t *testing.T, mappedRegistryPort int, containerdStore bool, opts ...testcontainers.CustomizeRequestOption,
+) (string, string) {
 	ctx := context.Background()
 	// Start unregistry in a Docker-in-Docker container with Docker using containerd image store.
 	req := testcontainers.GenericContainerRequest{
@@ -46,6 +56,9 @@ func runUnregistryDinD(t *testing.T, mappedRegistryPort int, containerdStore boo
 		},
 		Started: true,
 	}
+	for _, opt := range opts {
+		require.NoError(t, opt.Customize(&req))
+	}
 	ctr, err := testcontainers.GenericContainer(ctx, req)
 	require.NoError(t, err)
 
@@ -86,3 +99,53 @@ func runUnregistryDinD(t *testing.T, mappedRegistryPort int, containerdStore boo
 
 	return mappedDockerPort.Port(), mappedSSHPort.Port()
 }
+
+// runSSH runs the command in the unregistry container over SSH using the mapped SSH port and returns its output.
+func runSSH(t *testing.T, sshPort, command string) string {
+	t.Helper()
+
+	sshKeyPath := filepath.Join("ssh", "test_key")
+	// Change permission of the ssh key to 0600 to avoid SSH WARNING: UNPROTECTED PRIVATE KEY FILE!
+	require.NoError(t, os.Chmod(sshKeyPath, 0600), "Failed to change permission of SSH key")
+
+	cmd := exec.Command("ssh",
+		"-i", sshKeyPath,
+		"-p", sshPort,
+		"-o", "StrictHostKeyChecking=no",
+		"-o", "UserKnownHostsFile=/dev/null",
+		"-o", "LogLevel=ERROR",
+		"root@localhost",
+		command,
+	)
+	output, err := cmd.CombinedOutput()
+	require.NoError(t, err, "Failed to run '%s' over SSH: %s", command, string(output))
+
+	return string(output)
+}
+
+// manifestLayers returns the layer digests of the image manifest with the given tag or digest in the repository.
+func manifestLayers(t *testing.T, registryAddr, repo, reference string) []digest.Digest {
+	t.Helper()
+
+	req, err := http.NewRequest(
+		http.MethodGet, fmt.Sprintf("http://%s/v2/%s/manifests/%s", registryAddr, repo, url.PathEscape(reference)), nil,
+	)
+	require.NoError(t, err)
+	req.Header.Set("Accept", strings.Join([]string{
+		ocispec.MediaTypeImageManifest,
+		"application/vnd.docker.distribution.manifest.v2+json",
+	}, ", "))
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err, "Failed to get manifest '%s' of repository '%s'", reference, repo)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode, "Failed to get manifest '%s' of repository '%s'", reference, repo)
+
+	var manifest ocispec.Manifest
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&manifest), "Failed to decode manifest")
+	layers := make([]digest.Digest, len(manifest.Layers))
+	for i, layer := range manifest.Layers {
+		layers[i] = layer.Digest
+	}
+
+	return layers
+}